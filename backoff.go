@@ -0,0 +1,44 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+// backoff computes exponentially growing delays with jitter between retries
+// of a failing operation.
+type backoff struct {
+	Base time.Duration
+	Max  time.Duration
+
+	attempt int
+	random  func() float64
+}
+
+func newBackoff(base, max time.Duration) *backoff {
+	return &backoff{
+		Base:   base,
+		Max:    max,
+		random: rand.Float64,
+	}
+}
+
+// Next returns the delay before the next retry. The delay doubles with each
+// attempt up to the maximum and is randomized to between half and all of it.
+func (b *backoff) Next() time.Duration {
+	d := b.Base
+	for i := 0; i < b.attempt && d < b.Max; i++ {
+		d *= 2
+	}
+	if d > b.Max {
+		d = b.Max
+	}
+	b.attempt++
+
+	return d/2 + time.Duration(b.random()*float64(d/2))
+}
+
+// Reset starts over with the base delay after a successful attempt.
+func (b *backoff) Reset() {
+	b.attempt = 0
+}
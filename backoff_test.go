@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	b := newBackoff(time.Second, 10*time.Second)
+	// without jitter each delay is the full computed delay
+	b.random = func() float64 { return 1 }
+
+	want := []time.Duration{1, 2, 4, 8, 10, 10}
+	for i, w := range want {
+		if d := b.Next(); d != w*time.Second {
+			t.Errorf("attempt %d: delay = %v, want %v", i+1, d, w*time.Second)
+		}
+	}
+
+	b.Reset()
+	if d := b.Next(); d != time.Second {
+		t.Errorf("delay after reset = %v, want 1s", d)
+	}
+}
+
+func TestBackoffJitter(t *testing.T) {
+	b := newBackoff(4*time.Second, time.Minute)
+	b.random = func() float64 { return 0 }
+	if d := b.Next(); d != 2*time.Second {
+		t.Errorf("minimum delay = %v, want half of the base", d)
+	}
+
+	b = newBackoff(4*time.Second, time.Minute)
+	for i := 0; i < 100; i++ {
+		b.Reset()
+		if d := b.Next(); d < 2*time.Second || d > 4*time.Second {
+			t.Fatalf("delay %v out of range", d)
+		}
+	}
+}
@@ -4,35 +4,90 @@ import (
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"syscall"
 
 	"github.com/BurntSushi/toml"
 	log "github.com/Sirupsen/logrus"
 )
 
+// versions of the Rancher Metadata API
+var metadataVersions = []string{"latest", "2015-07-25", "2015-12-19", "2016-07-29"}
+
 type Config struct {
-	Interval        int        `toml:"interval"`
-	MetadataVersion string     `toml:"metadata-version"`
-	LogLevel        string     `toml:"log-level"`
-	OneTime         bool       `toml:"onetime"`
-	IncludeInactive bool       `toml:"include-inactive"`
-	Templates       []Template `toml:"template"`
+	Interval         int        `toml:"interval"`
+	MaxInterval      int        `toml:"max-interval"`
+	Debounce         int        `toml:"debounce"`
+	RenderTimeout    int        `toml:"render-timeout"`
+	MetadataVersion  string     `toml:"metadata-version"`
+	MetadataURL      string     `toml:"metadata-url"`
+	MetadataCAFile   string     `toml:"metadata-ca-file"`
+	MetadataCertFile string     `toml:"metadata-cert-file"`
+	MetadataKeyFile  string     `toml:"metadata-key-file"`
+	MetadataUsername string     `toml:"metadata-username"`
+	MetadataPassword string     `toml:"metadata-password"`
+	MetadataToken    string     `toml:"metadata-token"`
+	LogLevel         string     `toml:"log-level"`
+	OneTime          bool       `toml:"onetime"`
+	Watch            bool       `toml:"watch"`
+	DryRun           bool       `toml:"dry-run"`
+	Diff             bool       `toml:"diff"`
+	IncludeInactive  bool       `toml:"include-inactive"`
+	TolerateMissing  bool       `toml:"tolerate-missing"`
+	PrimaryLabel     string     `toml:"primary-label"`
+	CaseSensitive    bool       `toml:"case-sensitive"`
+	HealthListen     string     `toml:"health-listen"`
+	IgnoreFields     []string   `toml:"ignore-fields"`
+	Templates        []Template `toml:"template"`
 }
 
 type Template struct {
-	Source       string `toml:"source"`
-	Dest         string `toml:"dest"`
-	CheckCmd     string `toml:"check-cmd"`
-	NotifyCmd    string `toml:"notify-cmd"`
-	NotifyOutput bool   `toml:"notify-output"`
+	Source           string   `toml:"source"`
+	Dest             string   `toml:"dest"`
+	Dests            []string `toml:"dests"`
+	CheckCmd         string   `toml:"check-cmd"`
+	NotifyCmd        string   `toml:"notify-cmd"`
+	NotifyOutput     bool     `toml:"notify-output"`
+	NotifyTimeout    int      `toml:"notify-timeout"`
+	NotifyAttempts   int      `toml:"notify-attempts"`
+	NotifyRetryDelay int      `toml:"notify-retry-delay"`
+	NotifyPidfile    string   `toml:"notify-pidfile"`
+	NotifySignal     string   `toml:"notify-signal"`
+	Mode             string   `toml:"mode"`
+	UID              *int     `toml:"uid"`
+	GID              *int     `toml:"gid"`
+	Backup           bool     `toml:"backup"`
+	Partials         []string `toml:"partials"`
+	OnlyIf           []string `toml:"only-if"`
+	LeftDelim        string   `toml:"left-delim"`
+	RightDelim       string   `toml:"right-delim"`
+
+	perm   os.FileMode
+	signal syscall.Signal
+}
+
+// signals that can be sent to notify a process
+var notifySignals = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"TERM": syscall.SIGTERM,
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
 }
 
 func initConfig() (*Config, error) {
 	config := Config{
 		MetadataVersion: "latest",
+		MetadataURL:     MetadataURL,
 		Interval:        5,
+		MaxInterval:     300,
 		LogLevel:        "info",
+		PrimaryLabel:    "io.rancher.primary",
 	}
 
 	if len(configFile) > 0 {
@@ -52,6 +107,81 @@ func initConfig() (*Config, error) {
 		return nil, fmt.Errorf("Interval must be greater than 0")
 	}
 
+	if !validMetadataVersion(config.MetadataVersion) {
+		return nil, fmt.Errorf("Unknown metadata version: %s (supported: %s)",
+			config.MetadataVersion, strings.Join(metadataVersions, ", "))
+	}
+
+	if err := validateMetadataURL(config.MetadataURL); err != nil {
+		return nil, err
+	}
+
+	if err := validateMetadataAuth(&config); err != nil {
+		return nil, err
+	}
+
+	if config.Debounce < 0 {
+		return nil, fmt.Errorf("Debounce must not be negative")
+	}
+
+	if config.RenderTimeout < 0 {
+		return nil, fmt.Errorf("Render timeout must not be negative")
+	}
+
+	if config.MaxInterval < config.Interval {
+		config.MaxInterval = config.Interval
+	}
+
+	for i := range config.Templates {
+		config.Templates[i].Dest = expandEnv(config.Templates[i].Dest)
+		for j, dest := range config.Templates[i].Dests {
+			config.Templates[i].Dests[j] = expandEnv(dest)
+		}
+	}
+
+	templates, err := expandTemplateDirs(config.Templates)
+	if err != nil {
+		return nil, err
+	}
+	config.Templates = templates
+
+	for i := range config.Templates {
+		if config.Templates[i].NotifyTimeout < 0 {
+			return nil, fmt.Errorf("Notify timeout must not be negative")
+		}
+		if config.Templates[i].NotifyTimeout == 0 {
+			config.Templates[i].NotifyTimeout = 30
+		}
+		if config.Templates[i].NotifyAttempts < 0 || config.Templates[i].NotifyRetryDelay < 0 {
+			return nil, fmt.Errorf("Notify attempts and retry delay must not be negative")
+		}
+		if config.Templates[i].NotifyAttempts == 0 {
+			config.Templates[i].NotifyAttempts = 1
+		}
+		if config.Templates[i].NotifyRetryDelay == 0 {
+			config.Templates[i].NotifyRetryDelay = 1
+		}
+		if (len(config.Templates[i].LeftDelim) > 0) != (len(config.Templates[i].RightDelim) > 0) {
+			return nil, fmt.Errorf("Left and right delimiters of template '%s' must be set together", config.Templates[i].Source)
+		}
+		if config.Templates[i].NotifySignal == "" {
+			config.Templates[i].NotifySignal = "HUP"
+		}
+		name := strings.TrimPrefix(strings.ToUpper(config.Templates[i].NotifySignal), "SIG")
+		sig, ok := notifySignals[name]
+		if !ok {
+			return nil, fmt.Errorf("Invalid notify signal: %s", config.Templates[i].NotifySignal)
+		}
+		config.Templates[i].signal = sig
+		if mode := config.Templates[i].Mode; len(mode) > 0 {
+			perm, err := strconv.ParseUint(mode, 8, 32)
+			if err != nil || perm > 0777 {
+				return nil, fmt.Errorf("Invalid file mode: %s", mode)
+			}
+			config.Templates[i].perm = os.FileMode(perm)
+		}
+	}
+
 	lvl, err := log.ParseLevel(config.LogLevel)
 	if err != nil {
 		return nil, fmt.Errorf("Invalid log level: %s", config.LogLevel)
@@ -62,6 +192,111 @@ func initConfig() (*Config, error) {
 	return &config, nil
 }
 
+// validateMetadataURL checks that the base URL of the Metadata API is an
+// absolute HTTP or HTTPS URL.
+func validateMetadataURL(base string) error {
+	u, err := url.Parse(base)
+	if err != nil {
+		return fmt.Errorf("Invalid metadata URL: %v", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("Invalid metadata URL: %s (expected http(s)://host[:port][/path])", base)
+	}
+	return nil
+}
+
+// validateMetadataAuth checks that the TLS files for the Metadata API exist
+// and that at most one kind of credentials is given.
+func validateMetadataAuth(conf *Config) error {
+	if (len(conf.MetadataCertFile) > 0) != (len(conf.MetadataKeyFile) > 0) {
+		return fmt.Errorf("Metadata client certificate and key must be given together")
+	}
+	for _, f := range []string{conf.MetadataCAFile, conf.MetadataCertFile, conf.MetadataKeyFile} {
+		if len(f) == 0 {
+			continue
+		}
+		if _, err := os.Stat(f); err != nil {
+			return fmt.Errorf("Metadata TLS file not accessible: %v", err)
+		}
+	}
+	if len(conf.MetadataToken) > 0 && len(conf.MetadataUsername) > 0 {
+		return fmt.Errorf("Metadata token and username are mutually exclusive")
+	}
+	return nil
+}
+
+func validMetadataVersion(version string) bool {
+	for _, v := range metadataVersions {
+		if version == v {
+			return true
+		}
+	}
+	return false
+}
+
+// expandEnv replaces $VAR and ${VAR} in the path with the values of the
+// environment variables. Unset variables are replaced by an empty string.
+func expandEnv(path string) string {
+	return os.Expand(path, func(name string) string {
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			log.Warnf("Environment variable %s in destination path %s is not set", name, path)
+		}
+		return value
+	})
+}
+
+// destinations returns the paths the template is rendered to.
+func (t Template) destinations() []string {
+	dests := make([]string, 0, len(t.Dests)+1)
+	if t.Dest != "" {
+		dests = append(dests, t.Dest)
+	}
+	return append(dests, t.Dests...)
+}
+
+// expandTemplateDirs replaces templates whose source is a directory by one
+// template for each '*.tmpl' file in it. The destinations of each are the
+// file name without the extension in each of the destination directories.
+func expandTemplateDirs(templates []Template) ([]Template, error) {
+	result := make([]Template, 0, len(templates))
+	for _, t := range templates {
+		fi, err := os.Stat(t.Source)
+		if err != nil || !fi.IsDir() {
+			result = append(result, t)
+			continue
+		}
+
+		if len(t.Dest) == 0 && len(t.Dests) == 0 {
+			return nil, fmt.Errorf("Template directory '%s' requires a destination directory", t.Source)
+		}
+
+		matches, err := filepath.Glob(filepath.Join(t.Source, "*.tmpl"))
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) == 0 {
+			log.Warnf("No templates found in directory %s", t.Source)
+		}
+
+		for _, m := range matches {
+			name := strings.TrimSuffix(filepath.Base(m), ".tmpl")
+			tmpl := t
+			tmpl.Source = m
+			if len(t.Dest) > 0 {
+				tmpl.Dest = filepath.Join(t.Dest, name)
+			}
+			tmpl.Dests = nil
+			for _, dir := range t.Dests {
+				tmpl.Dests = append(tmpl.Dests, filepath.Join(dir, name))
+			}
+			result = append(result, tmpl)
+		}
+	}
+
+	return result, nil
+}
+
 func setConfigFromFile(path string, conf *Config) error {
 	buf, err := ioutil.ReadFile(path)
 	if err != nil {
@@ -78,11 +313,16 @@ func setConfigFromFile(path string, conf *Config) error {
 
 func setTemplateFromFlags(conf *Config) {
 	tmpl := Template{
-		Source:       flag.Arg(0),
-		Dest:         flag.Arg(1),
-		CheckCmd:     checkCmd,
-		NotifyCmd:    notifyCmd,
-		NotifyOutput: notifyOutput,
+		Source:           flag.Arg(0),
+		Dest:             flag.Arg(1),
+		CheckCmd:         checkCmd,
+		NotifyCmd:        notifyCmd,
+		NotifyOutput:     notifyOutput,
+		NotifyTimeout:    notifyTimeout,
+		NotifyAttempts:   notifyAttempts,
+		NotifyRetryDelay: notifyRetryDelay,
+		NotifyPidfile:    notifyPidfile,
+		NotifySignal:     notifySignal,
 	}
 	conf.Templates = []Template{tmpl}
 }
@@ -92,12 +332,53 @@ func overwriteConfigFromFlags(conf *Config) {
 		switch f.Name {
 		case "interval":
 			conf.Interval = interval
+		case "max-interval":
+			conf.MaxInterval = maxInterval
+		case "debounce":
+			conf.Debounce = debounce
+		case "render-timeout":
+			conf.RenderTimeout = renderTimeout
 		case "metadata-version":
 			conf.MetadataVersion = metadataVersion
+		case "metadata-url":
+			conf.MetadataURL = metadataBaseURL
+		case "metadata-ca-file":
+			conf.MetadataCAFile = metadataCAFile
+		case "metadata-cert-file":
+			conf.MetadataCertFile = metadataCertFile
+		case "metadata-key-file":
+			conf.MetadataKeyFile = metadataKeyFile
+		case "metadata-username":
+			conf.MetadataUsername = metadataUsername
+		case "metadata-password":
+			conf.MetadataPassword = metadataPassword
+		case "metadata-token":
+			conf.MetadataToken = metadataToken
 		case "onetime":
 			conf.OneTime = onetime
+		case "watch":
+			conf.Watch = watch
+		case "dry-run":
+			conf.DryRun = dryRun
+		case "diff":
+			conf.Diff = diff
 		case "include-inactive":
 			conf.IncludeInactive = includeInactive
+		case "tolerate-missing":
+			conf.TolerateMissing = tolerateMissing
+		case "primary-label":
+			conf.PrimaryLabel = primaryLabel
+		case "case-sensitive":
+			conf.CaseSensitive = caseSensitive
+		case "health-listen":
+			conf.HealthListen = healthListen
+		case "ignore-fields":
+			conf.IgnoreFields = nil
+			for _, f := range strings.Split(ignoreFields, ",") {
+				if f = strings.TrimSpace(f); f != "" {
+					conf.IgnoreFields = append(conf.IgnoreFields, f)
+				}
+			}
 		case "log-level":
 			conf.LogLevel = logLevel
 		}
@@ -120,6 +401,12 @@ func overwriteConfigFromEnv(conf *Config) {
 	if env = os.Getenv("RANCHER_GEN_METADATA_VER"); len(env) > 0 {
 		conf.MetadataVersion = env
 	}
+	if env = os.Getenv("RANCHER_GEN_METADATA_PASSWORD"); len(env) > 0 {
+		conf.MetadataPassword = env
+	}
+	if env = os.Getenv("RANCHER_GEN_METADATA_TOKEN"); len(env) > 0 {
+		conf.MetadataToken = env
+	}
 	if env = os.Getenv("RANCHER_GEN_ONETIME"); len(env) > 0 {
 		conf.OneTime = true
 	}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// loads the config from a file with the given content
+func loadConfig(t *testing.T, content string) (*Config, error) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	configFile = writeFile(t, filepath.Join(dir, "config.toml"), content)
+	defer func() { configFile = "" }()
+	return initConfig()
+}
+
+func TestInitConfig(t *testing.T) {
+	conf, err := loadConfig(t, `
+metadata-version = "2015-12-19"
+interval = 10
+
+[[template]]
+source = "/etc/in.tmpl"
+dest = "/etc/out"
+notify-signal = "sigusr1"
+mode = "0600"
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if conf.MetadataVersion != "2015-12-19" || conf.Interval != 10 || conf.MaxInterval != 300 {
+		t.Errorf("config = %+v", conf)
+	}
+	if conf.MetadataURL != MetadataURL || conf.PrimaryLabel != "io.rancher.primary" {
+		t.Errorf("defaults not applied: %+v", conf)
+	}
+	if len(conf.Templates) != 1 {
+		t.Fatalf("got %d templates", len(conf.Templates))
+	}
+	tmpl := conf.Templates[0]
+	if tmpl.NotifyTimeout != 30 || tmpl.NotifyAttempts != 1 || tmpl.NotifyRetryDelay != 1 {
+		t.Errorf("notify defaults not applied: %+v", tmpl)
+	}
+	if tmpl.signal != syscall.SIGUSR1 || tmpl.perm != 0600 {
+		t.Errorf("signal = %v, perm = %o", tmpl.signal, tmpl.perm)
+	}
+}
+
+func TestInitConfigErrors(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	cert := writeFile(t, filepath.Join(dir, "cert.pem"), "")
+
+	tests := []struct {
+		config  string
+		wantErr string
+	}{
+		{`interval = 0`, "Interval must be greater than 0"},
+		{`metadata-version = "2014-01-01"`, "Unknown metadata version"},
+		{`debounce = -1`, "Debounce must not be negative"},
+		{`render-timeout = -1`, "Render timeout must not be negative"},
+		{`log-level = "loud"`, "Invalid log level"},
+		{`metadata-url = "http://[::1"`, "Invalid metadata URL"},
+		{`metadata-url = "rancher-metadata"`, "Invalid metadata URL"},
+		{`metadata-url = "ftp://rancher-metadata"`, "Invalid metadata URL"},
+		{`metadata-cert-file = "` + cert + `"`, "must be given together"},
+		{`metadata-ca-file = "` + filepath.Join(dir, "missing.pem") + `"`, "not accessible"},
+		{"metadata-token = \"t\"\nmetadata-username = \"u\"", "mutually exclusive"},
+		{"[[template]]\nsource = \"in\"\nnotify-timeout = -1", "Notify timeout must not be negative"},
+		{"[[template]]\nsource = \"in\"\nnotify-attempts = -1", "must not be negative"},
+		{"[[template]]\nsource = \"in\"\nnotify-signal = \"KILL\"", "Invalid notify signal"},
+		{"[[template]]\nsource = \"in\"\nmode = \"0999\"", "Invalid file mode"},
+		{"[[template]]\nsource = \"in\"\nmode = \"01777\"", "Invalid file mode"},
+		{"[[template]]\nsource = \"in\"\nleft-delim = \"[[\"", "must be set together"},
+		{"[[template]]\nsource = \"" + dir + "\"", "requires a destination directory"},
+		{`interval = "often"`, "Could not load config file"},
+	}
+
+	for _, tt := range tests {
+		_, err := loadConfig(t, tt.config)
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%q: error = %v, want it to contain %q", tt.config, err, tt.wantErr)
+		}
+	}
+}
+
+func TestInitConfigMaxInterval(t *testing.T) {
+	conf, err := loadConfig(t, "interval = 30\nmax-interval = 10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.MaxInterval != 30 {
+		t.Errorf("MaxInterval = %d, want it raised to the interval", conf.MaxInterval)
+	}
+}
+
+func TestExpandTemplateDirs(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	writeFile(t, filepath.Join(dir, "a.conf.tmpl"), "a")
+	writeFile(t, filepath.Join(dir, "b.tmpl"), "b")
+	writeFile(t, filepath.Join(dir, "README"), "not a template")
+
+	templates, err := expandTemplateDirs([]Template{
+		{Source: dir, Dest: "/etc/out", NotifyCmd: "reload"},
+		{Source: "/etc/single.tmpl", Dest: "/etc/single"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Template{
+		{Source: filepath.Join(dir, "a.conf.tmpl"), Dest: "/etc/out/a.conf", NotifyCmd: "reload"},
+		{Source: filepath.Join(dir, "b.tmpl"), Dest: "/etc/out/b", NotifyCmd: "reload"},
+		{Source: "/etc/single.tmpl", Dest: "/etc/single"},
+	}
+	if !reflect.DeepEqual(templates, want) {
+		t.Errorf("expandTemplateDirs = %+v, want %+v", templates, want)
+	}
+}
+
+func TestExpandTemplateDirsDests(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	writeFile(t, filepath.Join(dir, "a.tmpl"), "a")
+	writeFile(t, filepath.Join(dir, "b.tmpl"), "b")
+
+	templates, err := expandTemplateDirs([]Template{{Source: dir, Dest: "/etc/out", Dests: []string{"/srv/x", "/srv/y"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(templates) != 2 {
+		t.Fatalf("got %d templates", len(templates))
+	}
+	if got, want := templates[1].destinations(), []string{"/etc/out/b", "/srv/x/b", "/srv/y/b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("destinations = %q, want %q", got, want)
+	}
+
+	// the shared slice of the directory isn't modified
+	if templates[0].Dests[0] != "/srv/x/a" {
+		t.Errorf("destinations of the first template = %q", templates[0].destinations())
+	}
+
+	templates, err = expandTemplateDirs([]Template{{Source: dir, Dests: []string{"/srv/x"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := templates[0].destinations(), []string{"/srv/x/a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("destinations without dest = %q, want %q", got, want)
+	}
+}
+
+func TestExpandEnv(t *testing.T) {
+	os.Setenv("RANCHER_GEN_TEST_DIR", "/srv")
+	defer os.Unsetenv("RANCHER_GEN_TEST_DIR")
+
+	tests := map[string]string{
+		"$RANCHER_GEN_TEST_DIR/out":          "/srv/out",
+		"${RANCHER_GEN_TEST_DIR}/out":        "/srv/out",
+		"/etc/${RANCHER_GEN_TEST_UNSET}/out": "/etc//out",
+		"/etc/out":                           "/etc/out",
+	}
+	for in, want := range tests {
+		if got := expandEnv(in); got != want {
+			t.Errorf("expandEnv(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestInitConfigExpandsDests(t *testing.T) {
+	os.Setenv("RANCHER_GEN_TEST_DIR", "/srv")
+	defer os.Unsetenv("RANCHER_GEN_TEST_DIR")
+
+	conf, err := loadConfig(t, `
+[[template]]
+source = "in.tmpl"
+dest = "$RANCHER_GEN_TEST_DIR/a"
+dests = ["${RANCHER_GEN_TEST_DIR}/b"]
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := conf.Templates[0].destinations(); !reflect.DeepEqual(got, []string{"/srv/a", "/srv/b"}) {
+		t.Errorf("destinations = %q", got)
+	}
+}
+
+func TestDestinations(t *testing.T) {
+	tests := []struct {
+		tmpl Template
+		want []string
+	}{
+		{Template{}, []string{}},
+		{Template{Dest: "a"}, []string{"a"}},
+		{Template{Dests: []string{"b", "c"}}, []string{"b", "c"}},
+		{Template{Dest: "a", Dests: []string{"b"}}, []string{"a", "b"}},
+	}
+	for _, tt := range tests {
+		if got := tt.tmpl.destinations(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("destinations(%+v) = %q, want %q", tt.tmpl, got, tt.want)
+		}
+	}
+}
+
+func TestValidMetadataVersion(t *testing.T) {
+	for _, v := range metadataVersions {
+		if !validMetadataVersion(v) {
+			t.Errorf("validMetadataVersion(%q) = false", v)
+		}
+	}
+	for _, v := range []string{"", "Latest", "2016-07-30"} {
+		if validMetadataVersion(v) {
+			t.Errorf("validMetadataVersion(%q) = true", v)
+		}
+	}
+}
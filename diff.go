@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// number of unchanged lines shown around each change
+const diffContext = 3
+
+type diffLine struct {
+	kind byte // ' ', '-' or '+'
+	text string
+}
+
+// unifiedDiff returns the unified diff between the lines of a and b or an
+// empty string if they are equal.
+func unifiedDiff(fromName, toName string, a, b []byte) string {
+	lines := diffLines(splitLines(a), splitLines(b))
+
+	// number of lines of a and b preceding each diff line
+	aPos := make([]int, len(lines)+1)
+	bPos := make([]int, len(lines)+1)
+	for i, l := range lines {
+		aPos[i+1], bPos[i+1] = aPos[i], bPos[i]
+		if l.kind != '+' {
+			aPos[i+1]++
+		}
+		if l.kind != '-' {
+			bPos[i+1]++
+		}
+	}
+
+	buf := new(bytes.Buffer)
+	for i := 0; i < len(lines); i++ {
+		if lines[i].kind == ' ' {
+			continue
+		}
+
+		// extend the hunk over changes separated by few unchanged lines
+		end := i
+		for {
+			j := end + 1
+			for j < len(lines) && lines[j].kind == ' ' {
+				j++
+			}
+			if j == len(lines) || j-end-1 > 2*diffContext {
+				break
+			}
+			end = j
+		}
+
+		start := i - diffContext
+		if start < 0 {
+			start = 0
+		}
+		stop := end + diffContext + 1
+		if stop > len(lines) {
+			stop = len(lines)
+		}
+
+		if buf.Len() == 0 {
+			fmt.Fprintf(buf, "--- %s\n+++ %s\n", fromName, toName)
+		}
+		fmt.Fprintf(buf, "@@ -%s +%s @@\n",
+			hunkRange(aPos[start], aPos[stop]-aPos[start]),
+			hunkRange(bPos[start], bPos[stop]-bPos[start]))
+		for _, l := range lines[start:stop] {
+			fmt.Fprintf(buf, "%c%s\n", l.kind, l.text)
+		}
+
+		i = stop - 1
+	}
+
+	return buf.String()
+}
+
+// diffLines computes the line edits turning a into b with the linear space
+// variant of the Myers algorithm. Inputs that differ in more than
+// diffMaxEdits lines produce larger diffs instead of taking quadratic time.
+func diffLines(a, b []string) []diffLine {
+	return appendDiff(make([]diffLine, 0, len(a)+len(b)), a, b)
+}
+
+// maximum number of edits searched for when splitting a diff
+const diffMaxEdits = 1000
+
+func appendDiff(result []diffLine, a, b []string) []diffLine {
+	// the common prefix and suffix are unchanged
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	for _, l := range a[:prefix] {
+		result = append(result, diffLine{' ', l})
+	}
+	a, b = a[prefix:], b[prefix:]
+
+	suffix := 0
+	for suffix < len(a) && suffix < len(b) && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	common := a[len(a)-suffix:]
+	a, b = a[:len(a)-suffix], b[:len(b)-suffix]
+
+	if x, y := middleSnake(a, b); x > 0 || y > 0 {
+		result = appendDiff(result, a[:x], b[:y])
+		result = appendDiff(result, a[x:], b[y:])
+	} else {
+		for _, l := range a {
+			result = append(result, diffLine{'-', l})
+		}
+		for _, l := range b {
+			result = append(result, diffLine{'+', l})
+		}
+	}
+
+	for _, l := range common {
+		result = append(result, diffLine{' ', l})
+	}
+	return result
+}
+
+// middleSnake returns the point where the shortest edit script turning a
+// into b can be split in two, searching from both ends at once. It returns
+// 0, 0 if a or b is empty, they have no line in common or the split wasn't
+// found within diffMaxEdits edits. a and b must neither start nor end with
+// the same line.
+func middleSnake(a, b []string) (int, int) {
+	n, m := len(a), len(b)
+	if n == 0 || m == 0 {
+		return 0, 0
+	}
+
+	maxD := (n + m + 1) / 2
+	if maxD > diffMaxEdits {
+		maxD = diffMaxEdits
+	}
+	offset := maxD
+	// furthest x reached on each diagonal k = x - y, searching forward from
+	// the start and backward from the end of both
+	forward := make([]int, 2*maxD+2)
+	backward := make([]int, 2*maxD+2)
+	for i := range forward {
+		forward[i], backward[i] = -1, -1
+	}
+	forward[offset+1], backward[offset+1] = 0, 0
+
+	delta := n - m
+	// the paths meet on a forward step if delta is odd, else on a backward one
+	odd := delta%2 != 0
+	kStart1, kEnd1, kStart2, kEnd2 := 0, 0, 0, 0
+
+	for d := 0; d < maxD; d++ {
+		for k := -d + kStart1; k <= d-kEnd1; k += 2 {
+			i := offset + k
+			var x int
+			if k == -d || (k != d && forward[i-1] < forward[i+1]) {
+				x = forward[i+1]
+			} else {
+				x = forward[i-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			forward[i] = x
+			switch {
+			case x > n:
+				kEnd1 += 2
+			case y > m:
+				kStart1 += 2
+			case odd:
+				j := offset + delta - k
+				if j >= 0 && j < len(backward) && backward[j] != -1 && x >= n-backward[j] {
+					return x, y
+				}
+			}
+		}
+
+		for k := -d + kStart2; k <= d-kEnd2; k += 2 {
+			i := offset + k
+			var x int
+			if k == -d || (k != d && backward[i-1] < backward[i+1]) {
+				x = backward[i+1]
+			} else {
+				x = backward[i-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[n-x-1] == b[m-y-1] {
+				x++
+				y++
+			}
+			backward[i] = x
+			switch {
+			case x > n:
+				kEnd2 += 2
+			case y > m:
+				kStart2 += 2
+			case !odd:
+				j := offset + delta - k
+				if j >= 0 && j < len(forward) && forward[j] != -1 && forward[j] >= n-x {
+					return forward[j], forward[j] - (j - offset)
+				}
+			}
+		}
+	}
+
+	return 0, 0
+}
+
+// formats the line range of a hunk header. The start line is 1-based
+// unless the range is empty.
+func hunkRange(before, length int) string {
+	start := before + 1
+	if length == 0 {
+		start = before
+	}
+	if length == 1 {
+		return fmt.Sprintf("%d", start)
+	}
+	return fmt.Sprintf("%d,%d", start, length)
+}
+
+func splitLines(content []byte) []string {
+	if len(content) == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+}
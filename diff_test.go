@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		want string
+	}{
+		{"equal", "a\nb\n", "a\nb\n", ""},
+		{"both empty", "", "", ""},
+		{"new file", "", "a\nb\n", "--- old\n+++ new\n@@ -0,0 +1,2 @@\n+a\n+b\n"},
+		{"removed file", "a\n", "", "--- old\n+++ new\n@@ -1 +0,0 @@\n-a\n"},
+		{"added line", "a\nb\nc\n", "a\nb\nx\nc\n", "--- old\n+++ new\n@@ -1,3 +1,4 @@\n a\n b\n+x\n c\n"},
+		{"removed line", "a\nb\nc\n", "a\nc\n", "--- old\n+++ new\n@@ -1,3 +1,2 @@\n a\n-b\n c\n"},
+		{"changed line", "a\nb\nc\n", "a\nB\nc\n", "--- old\n+++ new\n@@ -1,3 +1,3 @@\n a\n-b\n+B\n c\n"},
+		{"missing newline", "a", "a\n", ""},
+	}
+
+	for _, tt := range tests {
+		if got := unifiedDiff("old", "new", []byte(tt.a), []byte(tt.b)); got != tt.want {
+			t.Errorf("%s: unifiedDiff =\n%s\nwant\n%s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestUnifiedDiffHunks(t *testing.T) {
+	var a []string
+	for i := 1; i <= 20; i++ {
+		a = append(a, fmt.Sprintf("line %d", i))
+	}
+	b := append([]string{}, a...)
+	b[1] = "changed 2"
+	b[17] = "changed 18"
+
+	want := "--- old\n+++ new\n" +
+		"@@ -1,5 +1,5 @@\n line 1\n-line 2\n+changed 2\n line 3\n line 4\n line 5\n" +
+		"@@ -15,6 +15,6 @@\n line 15\n line 16\n line 17\n-line 18\n+changed 18\n line 19\n line 20\n"
+	got := unifiedDiff("old", "new", []byte(strings.Join(a, "\n")+"\n"), []byte(strings.Join(b, "\n")+"\n"))
+	if got != want {
+		t.Errorf("unifiedDiff =\n%s\nwant\n%s", got, want)
+	}
+
+	// changes separated by few unchanged lines share a hunk
+	b = append([]string{}, a...)
+	b[1] = "changed 2"
+	b[8] = "changed 9"
+	got = unifiedDiff("old", "new", []byte(strings.Join(a, "\n")+"\n"), []byte(strings.Join(b, "\n")+"\n"))
+	if n := strings.Count(got, "@@ -"); n != 1 {
+		t.Errorf("got %d hunks, want 1:\n%s", n, got)
+	}
+	if !strings.Contains(got, "@@ -1,12 +1,12 @@\n") {
+		t.Errorf("unexpected hunk header:\n%s", got)
+	}
+}
+
+func TestDiffLines(t *testing.T) {
+	a := []string{"a", "b", "c", "a", "b", "b", "a"}
+	b := []string{"c", "b", "a", "b", "a", "c"}
+
+	lines := diffLines(a, b)
+	var fromA, fromB []string
+	common := 0
+	for _, l := range lines {
+		if l.kind != '+' {
+			fromA = append(fromA, l.text)
+		}
+		if l.kind != '-' {
+			fromB = append(fromB, l.text)
+		}
+		if l.kind == ' ' {
+			common++
+		}
+	}
+	if strings.Join(fromA, "") != strings.Join(a, "") || strings.Join(fromB, "") != strings.Join(b, "") {
+		t.Errorf("diffLines doesn't reproduce its input: %v", lines)
+	}
+	// the longest common subsequence is 4 lines long, e.g. 'c a b a'
+	if common != 4 {
+		t.Errorf("diffLines kept %d common lines, want 4", common)
+	}
+}
+
+// length of the longest common subsequence of a and b
+func lcsLength(a, b []string) int {
+	prev := make([]int, len(b)+1)
+	for i := range a {
+		cur := make([]int, len(b)+1)
+		for j := range b {
+			if a[i] == b[j] {
+				cur[j+1] = prev[j] + 1
+			} else if prev[j+1] > cur[j] {
+				cur[j+1] = prev[j+1]
+			} else {
+				cur[j+1] = cur[j]
+			}
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+func TestDiffLinesMinimal(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	randomLines := func() []string {
+		lines := make([]string, rnd.Intn(30))
+		for i := range lines {
+			lines[i] = string(rune('a' + rnd.Intn(4)))
+		}
+		return lines
+	}
+
+	for n := 0; n < 2000; n++ {
+		a, b := randomLines(), randomLines()
+		var fromA, fromB []string
+		common := 0
+		for _, l := range diffLines(a, b) {
+			if l.kind != '+' {
+				fromA = append(fromA, l.text)
+			}
+			if l.kind != '-' {
+				fromB = append(fromB, l.text)
+			}
+			if l.kind == ' ' {
+				common++
+			}
+		}
+		if strings.Join(fromA, "") != strings.Join(a, "") || strings.Join(fromB, "") != strings.Join(b, "") {
+			t.Fatalf("diffLines(%q, %q) doesn't reproduce its input", a, b)
+		}
+		if want := lcsLength(a, b); common != want {
+			t.Fatalf("diffLines(%q, %q) kept %d common lines, want %d", a, b, common, want)
+		}
+	}
+}
+
+func TestDiffLinesLarge(t *testing.T) {
+	a := make([]string, 200000)
+	b := make([]string, 200000)
+	for i := range a {
+		a[i] = fmt.Sprintf("old %d", i)
+		b[i] = fmt.Sprintf("new %d", i)
+	}
+	// a small change in the middle of a large file
+	c := append([]string{}, a...)
+	c[100000] = "changed"
+
+	start := time.Now()
+	if got := len(diffLines(a, b)); got != len(a)+len(b) {
+		t.Errorf("diff of unrelated files has %d lines, want %d", got, len(a)+len(b))
+	}
+	if got := len(diffLines(a, c)); got != len(a)+1 {
+		t.Errorf("diff with one changed line has %d lines, want %d", got, len(a)+1)
+	}
+	if d := time.Since(start); d > 10*time.Second {
+		t.Errorf("diffing large files took %v", d)
+	}
+}
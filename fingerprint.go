@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/md5"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+)
+
+// contextFingerprint returns a hash of the exported content of the template
+// context. Struct fields named in ignore, either by field name like 'Health'
+// or qualified by type like 'Container.Health', are left out so that changes
+// to them alone don't change the fingerprint.
+func contextFingerprint(ctx *TemplateContext, ignore []string) string {
+	skip := make(map[string]bool, len(ignore))
+	for _, f := range ignore {
+		skip[f] = true
+	}
+
+	h := md5.New()
+	writeFingerprint(h, reflect.ValueOf(ctx), skip)
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+func writeFingerprint(h io.Writer, v reflect.Value, skip map[string]bool) {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			fmt.Fprint(h, "nil;")
+			return
+		}
+		writeFingerprint(h, v.Elem(), skip)
+	case reflect.Struct:
+		t := v.Type()
+		fmt.Fprint(h, "{")
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" || skip[f.Name] || skip[t.Name()+"."+f.Name] {
+				continue
+			}
+			fmt.Fprintf(h, "%s:", f.Name)
+			writeFingerprint(h, v.Field(i), skip)
+		}
+		fmt.Fprint(h, "}")
+	case reflect.Slice, reflect.Array:
+		fmt.Fprintf(h, "[%d:", v.Len())
+		for i := 0; i < v.Len(); i++ {
+			writeFingerprint(h, v.Index(i), skip)
+		}
+		fmt.Fprint(h, "]")
+	case reflect.Map:
+		keys := make([]string, 0, v.Len())
+		values := make(map[string]reflect.Value, v.Len())
+		for _, k := range v.MapKeys() {
+			key := fmt.Sprint(k.Interface())
+			keys = append(keys, key)
+			values[key] = v.MapIndex(k)
+		}
+		sort.Strings(keys)
+		fmt.Fprintf(h, "map[%d:", len(keys))
+		for _, k := range keys {
+			fmt.Fprintf(h, "%q:", k)
+			writeFingerprint(h, values[k], skip)
+		}
+		fmt.Fprint(h, "]")
+	default:
+		fmt.Fprintf(h, "%q;", fmt.Sprint(v.Interface()))
+	}
+}
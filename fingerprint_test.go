@@ -0,0 +1,36 @@
+package main
+
+import "testing"
+
+func TestContextFingerprint(t *testing.T) {
+	ctx := newTestContext()
+	fp := contextFingerprint(ctx, []string{"Health", "Container.State"})
+	if fp != contextFingerprint(newTestContext(), []string{"Health", "Container.State"}) {
+		t.Error("fingerprint of equal contexts differs")
+	}
+
+	// ignored fields don't change the fingerprint
+	ctx.Containers[0].Health = "unhealthy"
+	ctx.Services[0].Containers[0].Health = "unhealthy"
+	ctx.Containers[1].State = "stopped"
+	if got := contextFingerprint(ctx, []string{"Health", "Container.State"}); got != fp {
+		t.Error("fingerprint changed with ignored fields")
+	}
+
+	// other changes do
+	ctx.Hosts[0].Labels["zone"] = "c"
+	if got := contextFingerprint(ctx, []string{"Health", "Container.State"}); got == fp {
+		t.Error("fingerprint didn't change with a label")
+	}
+}
+
+func TestContextFingerprintMapOrder(t *testing.T) {
+	a, b := newTestContext(), newTestContext()
+	a.Hosts[2].Labels = LabelMap{"x": "1", "y": "2", "z": "3"}
+	b.Hosts[2].Labels = LabelMap{"z": "3", "y": "2", "x": "1"}
+	for i := 0; i < 10; i++ {
+		if contextFingerprint(a, nil) != contextFingerprint(b, nil) {
+			t.Fatal("fingerprint depends on map order")
+		}
+	}
+}
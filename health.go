@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Metrics counts the render cycles of the runner, i.e. the polls that found
+// a change of the Metadata and rendered the templates, the updated
+// destination files and the notify commands run.
+type Metrics struct {
+	RenderCycles     int64
+	TemplatesChanged int64
+	NotifyRuns       int64
+	Errors           int64
+	LastSuccess      time.Time
+
+	mu sync.Mutex
+}
+
+// record counts whether a poll failed or stores the time of its success.
+func (m *Metrics) record(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err != nil {
+		m.Errors++
+		return
+	}
+	m.LastSuccess = time.Now()
+}
+
+// count increments one of the counters.
+func (m *Metrics) count(counter *int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	*counter++
+}
+
+func (m *Metrics) snapshot() Metrics {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return Metrics{
+		RenderCycles:     m.RenderCycles,
+		TemplatesChanged: m.TemplatesChanged,
+		NotifyRuns:       m.NotifyRuns,
+		Errors:           m.Errors,
+		LastSuccess:      m.LastSuccess,
+	}
+}
+
+// healthHandler serves the health state of the runner on '/health' and its
+// metrics on '/metrics'. The runner is healthy if the last poll succeeded
+// within the threshold.
+func healthHandler(m *Metrics, threshold time.Duration) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, req *http.Request) {
+		s := m.snapshot()
+		if s.LastSuccess.IsZero() || time.Since(s.LastSuccess) > threshold {
+			http.Error(w, "stale", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, req *http.Request) {
+		s := m.snapshot()
+		var last int64
+		if !s.LastSuccess.IsZero() {
+			last = s.LastSuccess.Unix()
+		}
+		fmt.Fprintf(w, "rancher_gen_render_cycles_total %d\n", s.RenderCycles)
+		fmt.Fprintf(w, "rancher_gen_templates_changed_total %d\n", s.TemplatesChanged)
+		fmt.Fprintf(w, "rancher_gen_notify_runs_total %d\n", s.NotifyRuns)
+		fmt.Fprintf(w, "rancher_gen_errors_total %d\n", s.Errors)
+		fmt.Fprintf(w, "rancher_gen_last_success_timestamp_seconds %d\n", last)
+	})
+	return mux
+}
+
+func (r *runner) serveHealth() {
+	// allow for missed cycles and a full watch request
+	threshold := 3 * time.Duration(r.Config.Interval) * time.Second
+	if r.Config.Watch {
+		threshold += watchTimeout * time.Second
+	}
+
+	log.Infof("Serving health state on %s", r.Config.HealthListen)
+	err := http.ListenAndServe(r.Config.HealthListen, healthHandler(&r.Metrics, threshold))
+	log.Errorf("Health endpoint failed: %v", err)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHealthHandler(t *testing.T) {
+	m := &Metrics{}
+	h := healthHandler(m, time.Minute)
+
+	get := func(path string) (int, string) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		return rec.Code, rec.Body.String()
+	}
+
+	if code, _ := get("/health"); code != http.StatusServiceUnavailable {
+		t.Errorf("health before the first cycle = %d, want 503", code)
+	}
+
+	m.record(nil)
+	if code, body := get("/health"); code != http.StatusOK || body != "ok\n" {
+		t.Errorf("health after a successful cycle = %d %q", code, body)
+	}
+
+	m.LastSuccess = time.Now().Add(-2 * time.Minute)
+	if code, _ := get("/health"); code != http.StatusServiceUnavailable {
+		t.Errorf("health after a stale cycle = %d, want 503", code)
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	m := &Metrics{}
+	m.count(&m.RenderCycles)
+	m.count(&m.RenderCycles)
+	m.record(nil)
+	m.record(errors.New("failed"))
+	m.count(&m.TemplatesChanged)
+	m.count(&m.NotifyRuns)
+	m.count(&m.NotifyRuns)
+
+	rec := httptest.NewRecorder()
+	healthHandler(m, time.Minute).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	for _, want := range []string{
+		"rancher_gen_render_cycles_total 2\n",
+		"rancher_gen_templates_changed_total 1\n",
+		"rancher_gen_notify_runs_total 2\n",
+		"rancher_gen_errors_total 1\n",
+	} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("metrics don't contain %q:\n%s", want, rec.Body.String())
+		}
+	}
+	if strings.Contains(rec.Body.String(), "rancher_gen_last_success_timestamp_seconds 0\n") {
+		t.Error("last success timestamp not set")
+	}
+}
@@ -13,16 +13,40 @@ var (
 	Version string = "UNDEFINED"
 	GitSHA  string = "UNDEFINED"
 
-	configFile      string
-	metadataVersion string
-	logLevel        string
-	checkCmd        string
-	notifyCmd       string
-	onetime         bool
-	showVersion     bool
-	notifyOutput    bool
-	includeInactive bool
-	interval        int
+	configFile       string
+	metadataVersion  string
+	metadataBaseURL  string
+	metadataCAFile   string
+	metadataCertFile string
+	metadataKeyFile  string
+	metadataUsername string
+	metadataPassword string
+	metadataToken    string
+	logLevel         string
+	checkCmd         string
+	notifyCmd        string
+	notifyPidfile    string
+	notifySignal     string
+	primaryLabel     string
+	healthListen     string
+	ignoreFields     string
+	dumpContext      string
+	onetime          bool
+	watch            bool
+	dryRun           bool
+	diff             bool
+	showVersion      bool
+	notifyOutput     bool
+	includeInactive  bool
+	tolerateMissing  bool
+	caseSensitive    bool
+	interval         int
+	maxInterval      int
+	debounce         int
+	renderTimeout    int
+	notifyTimeout    int
+	notifyAttempts   int
+	notifyRetryDelay int
 )
 
 func init() {
@@ -31,16 +55,39 @@ func init() {
 
 	flag.StringVar(&configFile, "config", "", "Path to optional config file")
 	flag.StringVar(&metadataVersion, "metadata-version", "latest", "Metadata version to use for querying the Metadata API")
+	flag.StringVar(&metadataBaseURL, "metadata-url", MetadataURL, "URL of the Metadata API without the version")
+	flag.StringVar(&metadataCAFile, "metadata-ca-file", "", "Path to a CA bundle to verify the certificate of the Metadata API")
+	flag.StringVar(&metadataCertFile, "metadata-cert-file", "", "Path to a client certificate for the Metadata API")
+	flag.StringVar(&metadataKeyFile, "metadata-key-file", "", "Path to the key of the client certificate")
+	flag.StringVar(&metadataUsername, "metadata-username", "", "Username for basic auth against the Metadata API")
+	flag.StringVar(&metadataPassword, "metadata-password", "", "Password for basic auth against the Metadata API")
+	flag.StringVar(&metadataToken, "metadata-token", "", "Bearer token for the Metadata API")
 	flag.IntVar(&interval, "interval", 60, "Interval (in seconds) for polling the Metadata API for changes")
+	flag.IntVar(&debounce, "debounce", 0, "Period (in seconds) without further Metadata changes to wait for before rendering")
+	flag.IntVar(&renderTimeout, "render-timeout", 0, "Timeout (in seconds) after which rendering a template is aborted (0 to disable)")
+	flag.IntVar(&maxInterval, "max-interval", 300, "Maximum interval (in seconds) between retries while the Metadata API is unavailable")
 	flag.BoolVar(&includeInactive, "include-inactive", false, "Not yet implemented")
+	flag.BoolVar(&tolerateMissing, "tolerate-missing", false, "Skip templates that look up a missing service, container or host instead of failing")
+	flag.BoolVar(&caseSensitive, "case-sensitive", false, "Compare names and label values in lookups and selectors case-sensitively")
+	flag.StringVar(&primaryLabel, "primary-label", "io.rancher.primary", "Label designating the primary container of a service")
+	flag.StringVar(&ignoreFields, "ignore-fields", "", "Comma separated Metadata fields whose changes alone don't cause the templates to be rendered, e.g. 'Container.Health'")
+	flag.BoolVar(&watch, "watch", false, "Wait for changes of the Metadata instead of polling it in a fixed interval")
 	flag.BoolVar(&onetime, "onetime", false, "Process all templates once and exit")
+	flag.BoolVar(&diff, "diff", false, "Print the changes to the destination files to STDERR")
+	flag.BoolVar(&dryRun, "dry-run", false, "Render all templates once to STDOUT without updating the destinations")
+	flag.StringVar(&dumpContext, "dump-context", "", "Write the template context as JSON to the given file ('-' for STDOUT) and exit")
+	flag.StringVar(&healthListen, "health-listen", "", "Address to serve the health state and metrics on, e.g. ':8080'")
 	flag.StringVar(&logLevel, "log-level", "info", "Verbosity of log output (debug,info,warn,error)")
 	flag.StringVar(&checkCmd, "check-cmd", "", "Command to check the content before updating the destination file.")
 	flag.StringVar(&notifyCmd, "notify-cmd", "", "Command to run after the destination file has been updated.")
 	flag.BoolVar(&notifyOutput, "notify-output", false, "Print the result of the notify command to STDOUT")
+	flag.IntVar(&notifyTimeout, "notify-timeout", 30, "Timeout (in seconds) after which the notify command is killed")
+	flag.IntVar(&notifyAttempts, "notify-attempts", 1, "Number of times a failing notify command is run")
+	flag.IntVar(&notifyRetryDelay, "notify-retry-delay", 1, "Delay (in seconds) before the first retry of a failing notify command")
+	flag.StringVar(&notifyPidfile, "notify-pidfile", "", "Pidfile of a process to signal after the destination file has been updated")
+	flag.StringVar(&notifySignal, "notify-signal", "HUP", "Signal sent to the process in the notify pidfile (HUP,INT,QUIT,TERM,USR1,USR2)")
 	flag.BoolVar(&showVersion, "version", false, "Show application version and exit")
 	flag.Usage = printUsage
-	flag.Parse()
 }
 
 func printUsage() {
@@ -57,16 +104,23 @@ Arguments:
 }
 
 func main() {
+	flag.Parse()
+
 	if showVersion {
 		fmt.Printf("rancher-gen version %s (%s) \n", Version, GitSHA)
 		os.Exit(0)
 	}
 
-	if flag.NArg() < 1 && len(configFile) == 0 {
+	if flag.NArg() < 1 && len(configFile) == 0 && len(dumpContext) == 0 {
 		flag.Usage()
 		os.Exit(1)
 	}
 
+	if dumpContext == "-" || dryRun {
+		// keep the log out of the dumped JSON or rendered templates
+		log.SetOutput(os.Stderr)
+	}
+
 	log.Infof("Starting rancher-gen %s (%s)", Version, GitSHA)
 
 	conf, err := initConfig()
@@ -74,11 +128,23 @@ func main() {
 		log.Fatal(err.Error())
 	}
 
+	if conf.DryRun {
+		// dry-run may also be enabled in the config file
+		log.SetOutput(os.Stderr)
+	}
+
 	r, err := NewRunner(conf)
 	if err != nil {
 		log.Fatal(err.Error())
 	}
 
+	if len(dumpContext) > 0 {
+		if err := r.DumpContext(dumpContext); err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	}
+
 	if err := r.Run(); err != nil {
 		log.Fatal(err)
 	}
@@ -3,15 +3,21 @@ package main
 import (
 	"bytes"
 	"crypto/md5"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"syscall"
 	"text/template"
@@ -25,21 +31,64 @@ var (
 	MetadataURL = "http://rancher-metadata"
 )
 
+// matches the location in errors of text/template, e.g. 'template: name:3:14:'
+var templateErrorRegexp = regexp.MustCompile(`^template: ([^:]+):(\d+):`)
+
+// maximum time (in seconds) a watch request waits for a Metadata change
+const watchTimeout = 60
+
 type runner struct {
 	Config  *Config
 	Client  metadata.Client
 	Version string
+	Metrics Metrics
 
-	quitChan chan os.Signal
+	fingerprint string
+	backoff     *backoff
+	after       func(time.Duration) <-chan time.Time // time.After unless replaced in tests
+	quitChan    chan os.Signal
 }
 
-func NewRunner(conf *Config) (*runner, error) {
-	u, _ := url.Parse(MetadataURL)
-	u.Path = path.Join(u.Path, conf.MetadataVersion)
+// renderTimeoutError is returned if rendering a template takes longer than
+// the render timeout.
+type renderTimeoutError struct {
+	timeout time.Duration
+}
+
+func (e renderTimeoutError) Error() string {
+	return fmt.Sprintf("rendering timed out after %v", e.timeout)
+}
+
+// cycleSummary collects the outcome of a render cycle.
+type cycleSummary struct {
+	Changed  []string // updated destinations
+	Notified []string // notify commands run and processes signaled
+	Errors   int
+}
+
+// metadataError is returned by poll if the Metadata could not be fetched.
+type metadataError struct {
+	error
+}
+
+// errQuit is returned by waitForQuiet if an exit was requested by a signal.
+var errQuit = errors.New("exit requested while waiting for changes to settle")
 
+func NewRunner(conf *Config) (*runner, error) {
 	log.Infof("Initializing Rancher Metadata client (version %s)", conf.MetadataVersion)
 
-	client, err := metadata.NewClientAndWait(u.String())
+	transport, err := newMetadataTransport(conf)
+	if err != nil {
+		return nil, err
+	}
+	// the client library sends its requests with the default transport
+	http.DefaultTransport = transport
+
+	u, err := metadataURL(conf.MetadataURL, conf.MetadataVersion)
+	if err != nil {
+		return nil, err
+	}
+	client, err := metadata.NewClientAndWait(u)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to initialize Rancher Metadata client: %v", err)
 	}
@@ -51,26 +100,59 @@ func NewRunner(conf *Config) (*runner, error) {
 		Config:   conf,
 		Client:   client,
 		Version:  "init",
+		backoff:  newBackoff(time.Duration(conf.Interval)*time.Second, time.Duration(conf.MaxInterval)*time.Second),
+		after:    time.After,
 		quitChan: c,
 	}, nil
 }
 
+// metadataURL returns the URL of the given version of the Metadata API.
+func metadataURL(base, version string) (string, error) {
+	u, err := url.Parse(base)
+	if err != nil {
+		return "", fmt.Errorf("Invalid metadata URL: %v", err)
+	}
+	u.Path = path.Join(u.Path, version)
+	return u.String(), nil
+}
+
 func (r *runner) Run() error {
+	if r.Config.DryRun {
+		log.Info("Rendering all templates once without updating destinations.")
+		return r.poll()
+	}
+
 	if r.Config.OneTime {
 		log.Info("Processing all templates once.")
 		return r.poll()
 	}
 
-	log.Info("Polling Metadata with %d second interval", r.Config.Interval)
-	ticker := time.NewTicker(time.Duration(r.Config.Interval) * time.Second)
-	defer ticker.Stop()
+	if r.Config.HealthListen != "" {
+		go r.serveHealth()
+	}
+
+	if r.Config.Watch {
+		log.Info("Watching Metadata for changes")
+	} else {
+		log.Infof("Polling Metadata with %d second interval", r.Config.Interval)
+	}
 	for {
-		if err := r.poll(); err != nil {
-			log.Error(err)
+		wait := time.Duration(r.Config.Interval) * time.Second
+		watch := r.Config.Watch
+		err := r.poll()
+		if _, ok := err.(metadataError); ok {
+			wait = r.backoff.Next()
+			watch = false
+			log.Warnf("%v. Retrying in %s", err, wait)
+		} else {
+			r.backoff.Reset()
+			if err != nil {
+				log.Error(err)
+			}
 		}
 
 		select {
-		case <-ticker.C:
+		case <-r.nextPoll(wait, watch):
 		case signal := <-r.quitChan:
 			log.Info("Exit requested by signal: ", signal)
 			return nil
@@ -78,36 +160,157 @@ func (r *runner) Run() error {
 	}
 }
 
-func (r *runner) poll() error {
+// nextPoll returns a channel that is closed when the Metadata should be
+// polled again. When watching, that is as soon as the Metadata version
+// changes. Otherwise, or if watching fails, it is after the given delay.
+func (r *runner) nextPoll(wait time.Duration, watch bool) <-chan struct{} {
+	ch := make(chan struct{})
+	go func() {
+		defer close(ch)
+		if watch {
+			err := r.waitForChange()
+			if err == nil {
+				return
+			}
+			log.Warnf("Watching Metadata failed, polling instead: %v", err)
+		}
+		time.Sleep(wait)
+	}()
+	return ch
+}
+
+// waitForChange long-polls the Metadata version until it differs from the
+// last processed version or the watch timeout is reached.
+func (r *runner) waitForChange() error {
+	start := time.Now()
+	path := fmt.Sprintf("/version?wait=true&value=%s&maxWait=%d",
+		url.QueryEscape(strings.Trim(r.Version, `"`)), watchTimeout)
+	version, err := r.Client.SendRequest(path)
+	if err != nil {
+		return err
+	}
+
+	// a Metadata service without long-polling support returns at once
+	if string(version) == r.Version && time.Since(start) < time.Second {
+		return fmt.Errorf("Metadata service doesn't support watching")
+	}
+
+	return nil
+}
+
+// waitForQuiet waits until the Metadata version hasn't changed for the
+// debounce period, so that a burst of changes is rendered once. It stops
+// waiting after the maximum interval and returns the latest version. If an
+// exit is requested meanwhile it returns errQuit and leaves the signal for
+// Run.
+func (r *runner) waitForQuiet(version string) (string, error) {
+	quiet := time.Duration(r.Config.Debounce) * time.Second
+	deadline := time.Now().Add(time.Duration(r.Config.MaxInterval) * time.Second)
+	for time.Now().Before(deadline) {
+		select {
+		case <-r.after(quiet):
+		case sig := <-r.quitChan:
+			select {
+			case r.quitChan <- sig:
+			default:
+			}
+			return "", errQuit
+		}
+		newVersion, err := r.Client.GetVersion()
+		if err != nil {
+			return "", err
+		}
+		if newVersion == version {
+			break
+		}
+		log.Debugf("Metadata changed again, version %s", newVersion)
+		version = newVersion
+	}
+	return version, nil
+}
+
+func (r *runner) poll() (err error) {
+	defer func() { r.Metrics.record(err) }()
+
 	log.Debug("Checking for metadata change")
 	newVersion, err := r.Client.GetVersion()
 	if err != nil {
-		time.Sleep(time.Second * 2)
-		return fmt.Errorf("Failed to get Metadata version: %v", err)
+		return metadataError{fmt.Errorf("Failed to get Metadata version: %v", err)}
 	}
 
 	if r.Version == newVersion {
-		log.Debug("No changes in Metadata")
+		log.WithField("change", false).Debug("Checked Metadata version")
 		return nil
 	}
 
-	log.Debugf("Old version: %s, New Version: %s", r.Version, newVersion)
+	log.WithFields(log.Fields{
+		"change": true,
+		"old":    r.Version,
+		"new":    newVersion,
+	}).Debug("Checked Metadata version")
 
-	r.Version = newVersion
+	if r.Config.Debounce > 0 && r.Version != "init" {
+		newVersion, err = r.waitForQuiet(newVersion)
+		if err == errQuit {
+			// Run exits on the signal
+			return nil
+		}
+		if err != nil {
+			return metadataError{fmt.Errorf("Failed to get Metadata version: %v", err)}
+		}
+	}
+
+	start := time.Now()
 	ctx, err := r.createContext()
 	if err != nil {
-		time.Sleep(time.Second * 2)
-		return fmt.Errorf("Failed to create context from Rancher Metadata: %v", err)
+		return metadataError{fmt.Errorf("Failed to create context from Rancher Metadata: %v", err)}
+	}
+	log.WithFields(log.Fields{
+		"version":  newVersion,
+		"duration": time.Since(start),
+	}).Debug("Fetched Metadata")
+	r.Version = newVersion
+
+	var fingerprint string
+	if len(r.Config.IgnoreFields) > 0 {
+		fingerprint = contextFingerprint(ctx, r.Config.IgnoreFields)
+		if fingerprint == r.fingerprint {
+			log.WithField("change", false).Debug("Only ignored fields changed in Metadata")
+			return nil
+		}
 	}
 
+	r.Metrics.count(&r.Metrics.RenderCycles)
 	tmplFuncs := newFuncMap(ctx)
+	summary := &cycleSummary{Changed: []string{}, Notified: []string{}}
+	defer func() {
+		log.WithFields(log.Fields{
+			"changed":  summary.Changed,
+			"notified": summary.Notified,
+			"errors":   summary.Errors,
+		}).Info("Cycle complete")
+	}()
+
 	for _, tmpl := range r.Config.Templates {
-		if err := r.processTemplate(tmplFuncs, tmpl); err != nil {
-			return err
+		if err := r.processTemplate(ctx, tmplFuncs, tmpl, summary); err != nil {
+			summary.Errors++
+			// other templates aren't held up by one that timed out
+			var timeout renderTimeoutError
+			if !r.Config.DryRun && !r.Config.OneTime && !errors.As(err, &timeout) {
+				return err
+			}
+			log.Error(err)
 		}
 	}
 
-	if r.Config.OneTime {
+	if summary.Errors > 0 {
+		return fmt.Errorf("%d of %d templates failed", summary.Errors, len(r.Config.Templates))
+	}
+	r.fingerprint = fingerprint
+
+	if r.Config.DryRun {
+		log.Info("All templates rendered. Exiting.")
+	} else if r.Config.OneTime {
 		log.Info("All templates processed. Exiting.")
 	} else {
 		log.Info("All templates processed. Waiting for changes in Metadata...")
@@ -116,77 +319,323 @@ func (r *runner) poll() error {
 	return nil
 }
 
-func (r *runner) processTemplate(funcs template.FuncMap, t Template) error {
-	log.Debugf("Processing template %s for destination %s", t.Source, t.Dest)
+func (r *runner) processTemplate(ctx *TemplateContext, funcs template.FuncMap, t Template, summary *cycleSummary) error {
+	logger := log.WithField("template", t.Source)
+	logger.Debug("Processing template")
+	if len(t.OnlyIf) > 0 {
+		services, err := ctx.GetServices(t.OnlyIf...)
+		if err != nil {
+			return fmt.Errorf("Invalid condition for template '%s': %w", t.Source, err)
+		}
+		if len(services) == 0 {
+			logger.WithField("only-if", strings.Join(t.OnlyIf, " ")).Debug("Skipping template: no service matches")
+			return nil
+		}
+	}
+
 	if _, err := os.Stat(t.Source); os.IsNotExist(err) {
-		log.Fatalf("Template '%s' is missing", t.Source)
+		return fmt.Errorf("Template '%s' is missing", t.Source)
 	}
 
 	tmplBytes, err := ioutil.ReadFile(t.Source)
 	if err != nil {
-		log.Fatalf("Could not read template '%s': %v", t.Source, err)
+		return fmt.Errorf("Could not read template '%s': %w", t.Source, err)
 	}
 
 	name := filepath.Base(t.Source)
-	newTemplate, err := template.New(name).Funcs(funcs).Parse(string(tmplBytes))
+	newTemplate, err := template.New(name).Delims(t.LeftDelim, t.RightDelim).Funcs(funcs).Parse(string(tmplBytes))
 	if err != nil {
-		log.Fatalf("Could not parse template '%s': %v", t.Source, err)
+		return fmt.Errorf("Could not parse template '%s'%s: %w", t.Source, sourceLine(err, name, tmplBytes), err)
+	}
+
+	if err := parsePartials(newTemplate, t.Partials); err != nil {
+		return err
+	}
+
+	start := time.Now()
+	content, err := executeTemplate(newTemplate, ctx, time.Duration(r.Config.RenderTimeout)*time.Second)
+	if err != nil {
+		var notFound NotFoundError
+		if r.Config.TolerateMissing && errors.As(err, &notFound) {
+			logger.Warnf("Skipping template: %v", notFound)
+			return nil
+		}
+		return fmt.Errorf("Could not render template '%s'%s: %w", t.Source, sourceLine(err, name, tmplBytes), err)
 	}
 
-	buf := new(bytes.Buffer)
-	if err := newTemplate.Execute(buf, nil); err != nil {
-		log.Fatalf("Could not render template: '%s': %v", t.Source, err)
+	logger.WithField("duration", time.Since(start)).Debug("Rendered template")
+
+	dests := t.destinations()
+
+	if r.Config.Diff {
+		for _, dest := range dests {
+			if err := printDiff(content, dest); err != nil {
+				return err
+			}
+		}
 	}
 
-	content := buf.Bytes()
+	if r.Config.DryRun {
+		if r.Config.Diff && len(dests) > 0 {
+			return nil
+		}
+		if len(dests) == 0 {
+			dests = []string{"STDOUT"}
+		}
+		for _, dest := range dests {
+			fmt.Fprintf(os.Stdout, "==> %s <==\n", dest)
+			os.Stdout.Write(content)
+		}
+		return nil
+	}
 
-	if t.Dest == "" {
+	if len(dests) == 0 {
 		log.Debug("No destination specified. Printing to StdOut")
 		os.Stdout.Write(content)
 		return nil
 	}
 
-	log.Debug("Checking whether content has changed")
-	same, err := sameContent(content, t.Dest)
+	changed := false
+	for _, dest := range dests {
+		dt := t
+		dt.Dest = dest
+		destChanged, err := writeDestination(content, dt)
+		if err != nil {
+			return err
+		}
+		if destChanged {
+			summary.Changed = append(summary.Changed, dest)
+		}
+		changed = changed || destChanged
+	}
+	logger.WithField("change", changed).Debug("Checked destinations")
+
+	if !changed {
+		return nil
+	}
+	r.Metrics.count(&r.Metrics.TemplatesChanged)
+
+	if t.NotifyCmd != "" {
+		summary.Notified = append(summary.Notified, t.NotifyCmd)
+		if err := r.notifyWithRetry(t); err != nil {
+			return fmt.Errorf("Notify command failed: %v", err)
+		}
+	}
+
+	if t.NotifyPidfile != "" {
+		summary.Notified = append(summary.Notified, t.NotifyPidfile)
+		if err := signalProcess(t.NotifyPidfile, t.signal); err != nil {
+			logger.Errorf("Could not notify process: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// executeTemplate renders the template. If it doesn't finish within the
+// timeout an error is returned. text/template can't be canceled, so the
+// render keeps running in the background until it returns.
+func executeTemplate(tmpl *template.Template, ctx *TemplateContext, timeout time.Duration) ([]byte, error) {
+	if timeout <= 0 {
+		buf := new(bytes.Buffer)
+		err := tmpl.Execute(buf, ctx)
+		return buf.Bytes(), err
+	}
+
+	type result struct {
+		content []byte
+		err     error
+	}
+	done := make(chan result, 1)
+	go func() {
+		buf := new(bytes.Buffer)
+		err := tmpl.Execute(buf, ctx)
+		done <- result{buf.Bytes(), err}
+	}()
+
+	select {
+	case res := <-done:
+		return res.content, res.err
+	case <-time.After(timeout):
+		return nil, renderTimeoutError{timeout}
+	}
+}
+
+// signalProcess sends the signal to the process whose PID is stored in the
+// pidfile.
+func signalProcess(pidfile string, sig syscall.Signal) error {
+	b, err := ioutil.ReadFile(pidfile)
 	if err != nil {
-		return fmt.Errorf("Could not compare content for %s: %v", t.Dest, err)
+		return err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil || pid <= 0 {
+		return fmt.Errorf("Invalid PID in %s", pidfile)
+	}
+
+	log.WithFields(log.Fields{"signal": sig, "pid": pid}).Info("Signaling process")
+	if err := syscall.Kill(pid, sig); err != nil {
+		return fmt.Errorf("Could not signal process %d from %s: %v", pid, pidfile, err)
+	}
+	return nil
+}
+
+// notifyWithRetry runs the notify command of the template. A failing command
+// is retried with a growing delay until the configured number of attempts
+// is exhausted.
+func (r *runner) notifyWithRetry(t Template) error {
+	timeout := time.Duration(t.NotifyTimeout) * time.Second
+	b := newBackoff(time.Duration(t.NotifyRetryDelay)*time.Second, time.Duration(r.Config.MaxInterval)*time.Second)
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		r.Metrics.count(&r.Metrics.NotifyRuns)
+		if err = notify(t.NotifyCmd, t.NotifyOutput, timeout); err == nil || attempt >= t.NotifyAttempts {
+			return err
+		}
+
+		delay := b.Next()
+		log.Warnf("Notify command failed (attempt %d of %d): %v. Retrying in %s", attempt, t.NotifyAttempts, err, delay)
+		time.Sleep(delay)
+	}
+}
+
+// sourceLine returns the line of the template source a text/template error
+// refers to, formatted for inclusion in an error message, or an empty string
+// if the error doesn't refer to a line of the named template.
+func sourceLine(err error, name string, source []byte) string {
+	m := templateErrorRegexp.FindStringSubmatch(err.Error())
+	if m == nil || m[1] != name {
+		return ""
+	}
+
+	n, _ := strconv.Atoi(m[2])
+	lines := strings.Split(string(source), "\n")
+	if n < 1 || n > len(lines) {
+		return ""
+	}
+	return fmt.Sprintf(" at line %d '%s'", n, strings.TrimSpace(lines[n-1]))
+}
+
+// parsePartials adds the templates in the files matching the glob patterns
+// to the given template. Each can be invoked by its file name or the names
+// of the templates it defines.
+func parsePartials(tmpl *template.Template, patterns []string) error {
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return fmt.Errorf("Invalid partials pattern '%s': %v", pattern, err)
+		}
+		if len(matches) == 0 {
+			return fmt.Errorf("Partial '%s' is missing", pattern)
+		}
+
+		for _, m := range matches {
+			b, err := ioutil.ReadFile(m)
+			if err != nil {
+				return fmt.Errorf("Could not read partial '%s': %w", m, err)
+			}
+			if _, err := tmpl.New(filepath.Base(m)).Parse(string(b)); err != nil {
+				return fmt.Errorf("Could not parse partial '%s'%s: %w", m, sourceLine(err, filepath.Base(m), b), err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// printDiff prints the changes between the destination file and the
+// given content to STDERR.
+func printDiff(content []byte, dest string) error {
+	current, err := ioutil.ReadFile(dest)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Could not read destination file %s: %v", dest, err)
+	}
+
+	os.Stderr.WriteString(unifiedDiff(dest, dest+" (rendered)", current, content))
+	return nil
+}
+
+// writeDestination updates the destination file of the template with the
+// given content. It returns false if the destination was already up to date.
+func writeDestination(content []byte, t Template) (bool, error) {
+	dest := t.Dest
+	logger := log.WithField("dest", dest)
+	logger.Debug("Checking whether content has changed")
+	same, err := sameContent(content, dest)
+	if err != nil {
+		return false, fmt.Errorf("Could not compare content for %s: %v", dest, err)
 	}
 
 	if same {
-		log.Debugf("Destination %s is up to date", t.Dest)
-		return nil
+		logger.WithField("change", false).Debug("Destination is up to date")
+		return false, nil
 	}
 
 	log.Debug("Creating staging file")
-	stagingFile, err := createStagingFile(content, t.Dest)
+	stagingFile, err := createStagingFile(content, dest)
 	if err != nil {
-		return err
+		return false, err
+	}
+
+	if err := setFileMode(stagingFile, t); err != nil {
+		os.Remove(stagingFile)
+		return false, err
 	}
 
 	defer os.Remove(stagingFile)
 
 	if t.CheckCmd != "" {
 		if err := check(t.CheckCmd, stagingFile); err != nil {
-			return fmt.Errorf("Check command failed: %v", err)
+			return false, fmt.Errorf("Check command failed: %v", err)
 		}
 	}
 
-	log.Debugf("Writing destination")
-	if err = copyStagingToDestination(stagingFile, t.Dest); err != nil {
-		return fmt.Errorf("Could not write destination file %s: %v", t.Dest, err)
+	if t.Backup {
+		if err := backupDestination(dest); err != nil {
+			return false, fmt.Errorf("Could not back up destination file %s: %v", dest, err)
+		}
 	}
 
-	log.Info("Destination file %s has been updated", t.Dest)
+	logger.Debug("Writing destination")
+	if err = copyStagingToDestination(stagingFile, dest); err != nil {
+		return false, fmt.Errorf("Could not write destination file %s: %v", dest, err)
+	}
 
-	if t.NotifyCmd != "" {
-		if err := notify(t.NotifyCmd, t.NotifyOutput); err != nil {
-			return fmt.Errorf("Notify command failed: %v", err)
-		}
+	logger.WithField("change", true).Info("Destination file has been updated")
+
+	return true, nil
+}
+
+// backupDestination copies the current destination file to '<dest>.bak'
+// replacing any previous backup. Nothing is done if the destination doesn't
+// exist yet.
+func backupDestination(dest string) error {
+	content, err := ioutil.ReadFile(dest)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
 	}
 
-	return nil
+	fi, err := os.Stat(dest)
+	if err != nil {
+		return err
+	}
+
+	backup := dest + ".bak"
+	log.Debugf("Backing up destination to %s", backup)
+	if err := ioutil.WriteFile(backup, content, fi.Mode()); err != nil {
+		return err
+	}
+
+	return os.Chmod(backup, fi.Mode())
 }
 
+// copyStagingToDestination atomically replaces the destination file with
+// the staging file. If the files live in different mounts the content is
+// copied instead, which is not atomic.
 func copyStagingToDestination(stagingPath, destPath string) error {
 	err := os.Rename(stagingPath, destPath)
 	if err == nil {
@@ -225,6 +674,31 @@ func copyStagingToDestination(stagingPath, destPath string) error {
 	return nil
 }
 
+// DumpContext writes the template context created from the current Metadata
+// as JSON to the given file or to STDOUT if the path is '-'.
+func (r *runner) DumpContext(path string) error {
+	ctx, err := r.createContext()
+	if err != nil {
+		return fmt.Errorf("Failed to create context from Rancher Metadata: %v", err)
+	}
+
+	content, err := json.MarshalIndent(ctx, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Failed to encode context: %v", err)
+	}
+	content = append(content, '\n')
+
+	if path == "-" {
+		_, err = os.Stdout.Write(content)
+		return err
+	}
+	if err := ioutil.WriteFile(path, content, 0644); err != nil {
+		return fmt.Errorf("Could not write context to %s: %v", path, err)
+	}
+	log.Infof("Wrote template context to %s", path)
+	return nil
+}
+
 func (r *runner) createContext() (*TemplateContext, error) {
 	log.Debug("Fetching Metadata")
 
@@ -232,11 +706,11 @@ func (r *runner) createContext() (*TemplateContext, error) {
 	if err != nil {
 		return nil, err
 	}
-	metaContainers, err := r.Client.GetContainers()
+	metaContainers, err := r.getContainers()
 	if err != nil {
 		return nil, err
 	}
-	metaHosts, err := r.Client.GetHosts()
+	metaHosts, err := r.getHosts()
 	if err != nil {
 		return nil, err
 	}
@@ -248,11 +722,12 @@ func (r *runner) createContext() (*TemplateContext, error) {
 	hosts := make([]Host, 0)
 	for _, h := range metaHosts {
 		host := Host{
-			UUID:     h.UUID,
-			Name:     h.Name,
-			Address:  h.AgentIP,
-			Hostname: h.Hostname,
-			Labels:   LabelMap(h.Labels),
+			UUID:       h.UUID,
+			Name:       h.Name,
+			Address:    h.AgentIP,
+			Hostname:   h.Hostname,
+			AgentState: h.AgentState,
+			Labels:     LabelMap(h.Labels),
 		}
 		hosts = append(hosts, host)
 	}
@@ -260,13 +735,18 @@ func (r *runner) createContext() (*TemplateContext, error) {
 	containers := make([]Container, 0)
 	for _, c := range metaContainers {
 		container := Container{
-			Name:    c.Name,
-			Address: c.PrimaryIp,
-			Stack:   c.StackName,
-			Service: c.ServiceName,
-			Health:  c.HealthState,
-			State:   c.State,
-			Labels:  LabelMap(c.Labels),
+			UUID:     c.UUID,
+			Name:     c.Name,
+			Address:  c.PrimaryIp,
+			IPs:      append([]string{}, c.Ips...),
+			Ports:    parseContainerPorts(c.Ports),
+			Stack:    c.StackName,
+			Service:  c.ServiceName,
+			Health:   c.HealthState,
+			State:    c.State,
+			Labels:   LabelMap(c.Labels),
+			HostUUID: c.HostUUID,
+			Image:    strings.TrimPrefix(c.ImageUUID, "docker:"),
 		}
 		for _, h := range hosts {
 			if h.UUID == c.HostUUID {
@@ -280,11 +760,13 @@ func (r *runner) createContext() (*TemplateContext, error) {
 	services := make([]Service, 0)
 	for _, s := range metaServices {
 		service := Service{
+			UUID:     s.UUID,
 			Name:     s.Name,
 			Stack:    s.StackName,
 			Kind:     s.Kind,
 			Vip:      s.Vip,
 			Fqdn:     s.Fqdn,
+			Scale:    s.Scale,
 			Labels:   LabelMap(s.Labels),
 			Metadata: MetadataMap(s.Metadata),
 		}
@@ -295,14 +777,19 @@ func (r *runner) createContext() (*TemplateContext, error) {
 			}
 		}
 		service.Containers = svcContainers
+		service.Sidekicks = append([]string{}, s.Sidekicks...)
+		service.Links = serviceLinks(s.Links, s.StackName)
 		service.Ports = parseServicePorts(s.Ports)
+		service.PublicEndpoints = publicEndpoints(service.Ports, svcContainers)
 		services = append(services, service)
 	}
 
 	self := Self{
-		Stack:    metaSelf.StackName,
-		Service:  metaSelf.ServiceName,
-		HostUUID: metaSelf.HostUUID,
+		ContainerName: metaSelf.Name,
+		Stack:         metaSelf.StackName,
+		Service:       metaSelf.ServiceName,
+		HostUUID:      metaSelf.HostUUID,
+		Labels:        LabelMap(metaSelf.Labels),
 	}
 
 	ctx := TemplateContext{
@@ -310,19 +797,69 @@ func (r *runner) createContext() (*TemplateContext, error) {
 		Containers: containers,
 		Hosts:      hosts,
 		Self:       self,
+
+		primaryLabel:  r.Config.PrimaryLabel,
+		caseSensitive: r.Config.CaseSensitive,
 	}
 
 	return &ctx, nil
 }
 
-// converts Metadata.Service.Ports string slice to a ServicePort slice
+// metadataHost extends metadata.Host with fields the client library
+// doesn't decode.
+type metadataHost struct {
+	metadata.Host
+	AgentState string `json:"agent_state"`
+}
+
+// metadataContainer extends metadata.Container with fields the client
+// library doesn't decode.
+type metadataContainer struct {
+	metadata.Container
+	ImageUUID string `json:"image_uuid"`
+}
+
+func (r *runner) getContainers() ([]metadataContainer, error) {
+	resp, err := r.Client.SendRequest("/containers")
+	if err != nil {
+		return nil, err
+	}
+
+	var containers []metadataContainer
+	if err = json.Unmarshal(resp, &containers); err != nil {
+		return nil, err
+	}
+	return containers, nil
+}
+
+func (r *runner) getHosts() ([]metadataHost, error) {
+	resp, err := r.Client.SendRequest("/hosts")
+	if err != nil {
+		return nil, err
+	}
+
+	var hosts []metadataHost
+	if err = json.Unmarshal(resp, &hosts); err != nil {
+		return nil, err
+	}
+	return hosts, nil
+}
+
+// converts Metadata.Service.Ports string slice to a ServicePort slice.
+// The ports are expected in the form '[bind-ip:]public-port:internal-port/protocol'.
 func parseServicePorts(ports []string) []ServicePort {
 	var ret []ServicePort
 	for _, port := range ports {
-		if parts := strings.Split(port, ":"); len(parts) == 2 {
+		parts := strings.Split(port, ":")
+		if len(parts) == 2 || len(parts) == 3 {
+			var bindAddress string
+			if len(parts) == 3 {
+				bindAddress, parts = parts[0], parts[1:]
+			}
 			public := parts[0]
 			if parts_ := strings.Split(parts[1], "/"); len(parts_) == 2 {
 				ret = append(ret, ServicePort{
+					BindAddress:  bindAddress,
 					PublicPort:   public,
 					InternalPort: parts_[0],
 					Protocol:     parts_[1],
@@ -336,6 +873,75 @@ func parseServicePorts(ports []string) []ServicePort {
 	return ret
 }
 
+// converts Metadata.Container.Ports string slice to a PortBinding slice.
+// The ports are expected in the form '[[ip:]public-port:]private-port/protocol'.
+func parseContainerPorts(ports []string) []PortBinding {
+	var ret []PortBinding
+	for _, port := range ports {
+		parts := strings.Split(port, ":")
+		if len(parts) <= 3 {
+			var binding PortBinding
+			if len(parts) == 3 {
+				binding.IP, parts = parts[0], parts[1:]
+			}
+			if len(parts) == 2 {
+				binding.PublicPort, parts = parts[0], parts[1:]
+			}
+			if parts_ := strings.Split(parts[0], "/"); len(parts_) == 2 {
+				binding.PrivatePort, binding.Protocol = parts_[0], parts_[1]
+				ret = append(ret, binding)
+				continue
+			}
+		}
+		log.Warnf("Unexpected format of container port: %s", port)
+	}
+
+	return ret
+}
+
+// returns the identifiers in the form 'service-name.stack-name' of the
+// services targeted by the links of a service. The metadata keys links by
+// 'stack-name/service-name' or by the service name within the same stack.
+func serviceLinks(links map[string]string, stack string) []string {
+	ret := make([]string, 0, len(links))
+	for target := range links {
+		parts := strings.SplitN(target, "/", 2)
+		if len(parts) == 2 {
+			ret = append(ret, parts[1]+"."+parts[0])
+		} else {
+			ret = append(ret, target+"."+stack)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// returns the addresses the ports of a service are published on. Unless
+// a port is bound to a specific IP it is published on the hosts running
+// the service's containers.
+func publicEndpoints(ports []ServicePort, containers []Container) []PublicEndpoint {
+	ret := make([]PublicEndpoint, 0)
+	seen := make(map[PublicEndpoint]bool)
+	add := func(ep PublicEndpoint) {
+		if ep.IPAddress != "" && !seen[ep] {
+			seen[ep] = true
+			ret = append(ret, ep)
+		}
+	}
+
+	for _, p := range ports {
+		if p.BindAddress != "" && p.BindAddress != "0.0.0.0" {
+			add(PublicEndpoint{p.BindAddress, p.PublicPort, p.Protocol})
+			continue
+		}
+		for _, c := range containers {
+			add(PublicEndpoint{c.Host.Address, p.PublicPort, p.Protocol})
+		}
+	}
+
+	return ret
+}
+
 func check(command, filePath string) error {
 	command = strings.Replace(command, "{{staging}}", filePath, -1)
 	log.Debugf("Running check command '%s'", command)
@@ -350,11 +956,14 @@ func check(command, filePath string) error {
 	return nil
 }
 
-func notify(command string, verbose bool) error {
-	log.Infof("Executing notify command '%s'", command)
-	cmd := exec.Command("/bin/sh", "-c", command)
-	out, err := cmd.CombinedOutput()
+func notify(command string, verbose bool, timeout time.Duration) error {
+	logger := log.WithField("command", command)
+	logger.Info("Executing notify command")
+	start := time.Now()
+	out, err := runCommand(command, timeout)
+	logger = logger.WithField("duration", time.Since(start))
 	if err != nil {
+		logger.Debug("Notify command failed")
 		logCmdOutput(command, out)
 		return err
 	}
@@ -363,10 +972,39 @@ func notify(command string, verbose bool) error {
 		logCmdOutput(command, out)
 	}
 
-	log.Debugf("Notify cmd output: %q", string(out))
+	logger.WithField("output", string(out)).Debug("Notify command succeeded")
 	return nil
 }
 
+// runCommand runs the command in a shell and returns it's combined output.
+// If the command doesn't exit within the timeout it is killed along with
+// any processes it has spawned.
+func runCommand(command string, timeout time.Duration) ([]byte, error) {
+	var out bytes.Buffer
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		return out.Bytes(), err
+	case <-time.After(timeout):
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-done
+		return out.Bytes(), fmt.Errorf("command timed out after %v", timeout)
+	}
+}
+
 func logCmdOutput(command string, output []byte) {
 	for _, line := range strings.Split(string(output), "\n") {
 		if line != "" {
@@ -415,6 +1053,40 @@ func computeFileMd5(filePath string) (string, error) {
 	return fmt.Sprintf("%x", hash.Sum(nil)), nil
 }
 
+// setFileMode applies the file mode and ownership configured for the template
+// to the staging file. Without a configured mode, new files are created with
+// mode 0644 and existing files keep their mode.
+func setFileMode(stagingFile string, t Template) error {
+	var perm os.FileMode
+	if len(t.Mode) > 0 {
+		perm = t.perm
+	} else if _, err := os.Stat(t.Dest); os.IsNotExist(err) {
+		perm = 0644
+	}
+
+	// otherwise the mode copied from the existing destination is kept
+	if len(t.Mode) > 0 || perm != 0 {
+		if err := os.Chmod(stagingFile, perm); err != nil {
+			return fmt.Errorf("Failed to set file mode of %s: %v", t.Dest, err)
+		}
+	}
+
+	if t.UID != nil || t.GID != nil {
+		uid, gid := -1, -1
+		if t.UID != nil {
+			uid = *t.UID
+		}
+		if t.GID != nil {
+			gid = *t.GID
+		}
+		if err := os.Chown(stagingFile, uid, gid); err != nil {
+			return fmt.Errorf("Failed to set ownership of %s: %v", t.Dest, err)
+		}
+	}
+
+	return nil
+}
+
 func createStagingFile(content []byte, destFile string) (string, error) {
 	fp, err := ioutil.TempFile(filepath.Dir(destFile), "."+filepath.Base(destFile)+"-")
 	if err != nil {
@@ -447,6 +1119,17 @@ func createStagingFile(content []byte, destFile string) (string, error) {
 		}
 	}
 
-	fp.Close()
+	// Flush the content to disk before the staging file is renamed
+	// so that the destination can never be observed truncated.
+	if err := fp.Sync(); err != nil {
+		onErr()
+		return "", fmt.Errorf("Could not sync staging file for %s: %v", destFile, err)
+	}
+
+	if err := fp.Close(); err != nil {
+		os.Remove(fp.Name())
+		return "", fmt.Errorf("Could not close staging file for %s: %v", destFile, err)
+	}
+
 	return fp.Name(), nil
 }
@@ -0,0 +1,1036 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"text/template"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/rancher/go-rancher-metadata/metadata"
+)
+
+// fakeClient serves the Metadata of a single stack from memory.
+type fakeClient struct {
+	versions   []string // returned in order, the last one repeats
+	services   []metadata.Service
+	containers []metadataContainer
+	hosts      []metadataHost
+	self       metadata.Container
+
+	versionCalls int
+}
+
+func newFakeClient() *fakeClient {
+	container := func(name, service, ip, health, host string, labels map[string]string) metadataContainer {
+		return metadataContainer{
+			Container: metadata.Container{
+				Name: name, UUID: "uuid-" + name, PrimaryIp: ip, Ips: []string{ip},
+				StackName: "web", ServiceName: service, HealthState: health, State: "running",
+				HostUUID: host, Labels: labels,
+			},
+			ImageUUID: "docker:nginx:1",
+		}
+	}
+
+	return &fakeClient{
+		versions: []string{"1"},
+		services: []metadata.Service{
+			{Name: "web", StackName: "web", UUID: "svc-web", Kind: "service", Scale: 2,
+				Ports: []string{"80:8080/tcp"}, Links: map[string]string{"db": "db", "other/api": "api"},
+				Labels: map[string]string{"tier": "frontend"}},
+			{Name: "db", StackName: "web", UUID: "svc-db", Kind: "service", Scale: 1},
+		},
+		containers: []metadataContainer{
+			container("web_web_1", "web", "10.0.0.1", "healthy", "host-1", map[string]string{"tier": "web"}),
+			container("web_web_2", "web", "10.0.0.2", "healthy", "host-2", map[string]string{"tier": "web"}),
+			container("web_db_1", "db", "10.0.0.3", "healthy", "host-1", nil),
+		},
+		hosts: []metadataHost{
+			{Host: metadata.Host{Name: "node1", UUID: "host-1", AgentIP: "192.168.0.1"}, AgentState: "active"},
+			{Host: metadata.Host{Name: "node2", UUID: "host-2", AgentIP: "192.168.0.2"}, AgentState: "active"},
+		},
+		self: metadata.Container{Name: "web_web_1", StackName: "web", ServiceName: "web", HostUUID: "host-1",
+			Labels: map[string]string{"io.rancher.stack.name": "web"}},
+	}
+}
+
+func (f *fakeClient) SendRequest(path string) ([]byte, error) {
+	switch {
+	case path == "/containers":
+		return json.Marshal(f.containers)
+	case path == "/hosts":
+		return json.Marshal(f.hosts)
+	case strings.HasPrefix(path, "/version"):
+		return []byte(f.versions[len(f.versions)-1]), nil
+	}
+	return nil, fmt.Errorf("unexpected request %s", path)
+}
+
+func (f *fakeClient) GetVersion() (string, error) {
+	v := f.versions[0]
+	if len(f.versions) > 1 {
+		f.versions = f.versions[1:]
+	}
+	f.versionCalls++
+	return v, nil
+}
+
+func (f *fakeClient) OnChange(int, func(string))                    {}
+func (f *fakeClient) GetSelfHost() (metadata.Host, error)           { return metadata.Host{}, nil }
+func (f *fakeClient) GetSelfContainer() (metadata.Container, error) { return f.self, nil }
+func (f *fakeClient) GetSelfServiceByName(string) (metadata.Service, error) {
+	return metadata.Service{}, nil
+}
+func (f *fakeClient) GetSelfService() (metadata.Service, error)    { return metadata.Service{}, nil }
+func (f *fakeClient) GetSelfStack() (metadata.Stack, error)        { return metadata.Stack{}, nil }
+func (f *fakeClient) GetServices() ([]metadata.Service, error)     { return f.services, nil }
+func (f *fakeClient) GetStacks() ([]metadata.Stack, error)         { return nil, nil }
+func (f *fakeClient) GetContainers() ([]metadata.Container, error) { return nil, nil }
+func (f *fakeClient) GetServiceContainers(string, string) ([]metadata.Container, error) {
+	return nil, nil
+}
+func (f *fakeClient) GetHosts() ([]metadata.Host, error)    { return nil, nil }
+func (f *fakeClient) GetHost(string) (metadata.Host, error) { return metadata.Host{}, nil }
+
+func newTestRunner(client *fakeClient, templates ...Template) *runner {
+	for i := range templates {
+		if templates[i].NotifyTimeout == 0 {
+			templates[i].NotifyTimeout = 10
+		}
+		if templates[i].NotifyAttempts == 0 {
+			templates[i].NotifyAttempts = 1
+		}
+		if templates[i].NotifyRetryDelay == 0 {
+			templates[i].NotifyRetryDelay = 1
+		}
+	}
+	conf := &Config{
+		Interval:     1,
+		MaxInterval:  1,
+		PrimaryLabel: "io.rancher.primary",
+		Templates:    templates,
+	}
+	return &runner{
+		Config:  conf,
+		Client:  client,
+		Version: "init",
+		backoff: newBackoff(time.Second, time.Second),
+		after:   time.After,
+	}
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "rancher-gen-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func writeFile(t *testing.T, path, content string) string {
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func readFile(t *testing.T, path string) string {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+// runs f with os.Stdout redirected and returns what was written to it
+func captureStdout(t *testing.T, f func()) string {
+	tmp, err := ioutil.TempFile("", "rancher-gen-stdout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	stdout := os.Stdout
+	os.Stdout = tmp
+	defer func() { os.Stdout = stdout }()
+	f()
+
+	return readFile(t, tmp.Name())
+}
+
+// runs f with the standard logger writing at level to a buffer and
+// returns what was logged
+func captureLog(level log.Level, f func()) string {
+	logger := log.StandardLogger()
+	out, formatter, old := logger.Out, logger.Formatter, logger.Level
+	defer func() {
+		log.SetOutput(out)
+		log.SetFormatter(formatter)
+		log.SetLevel(old)
+	}()
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	log.SetFormatter(&log.TextFormatter{DisableTimestamp: true, DisableColors: true})
+	log.SetLevel(level)
+	f()
+
+	return buf.String()
+}
+
+func TestCreateContext(t *testing.T) {
+	r := newTestRunner(newFakeClient())
+	ctx, err := r.createContext()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := ctx.GetContainer("web_db_1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Image != "nginx:1" || c.Host.Name != "node1" || c.Address != "10.0.0.3" {
+		t.Errorf("container = %+v", c)
+	}
+	if h, _ := ctx.GetHost("host-2"); h.AgentState != "active" || h.Address != "192.168.0.2" {
+		t.Errorf("host = %+v", h)
+	}
+
+	s, err := ctx.GetService("web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := containerNames(s.Containers); got != "web_web_1,web_web_2" {
+		t.Errorf("service containers = %q", got)
+	}
+	if want := []string{"api.other", "db.web"}; !reflect.DeepEqual(s.Links, want) {
+		t.Errorf("service links = %q, want %q", s.Links, want)
+	}
+	if len(s.PublicEndpoints) != 2 || s.PublicEndpoints[1].IPAddress != "192.168.0.2" {
+		t.Errorf("public endpoints = %+v", s.PublicEndpoints)
+	}
+	if ctx.Self.Stack != "web" || ctx.primaryLabel != "io.rancher.primary" {
+		t.Errorf("self = %+v", ctx.Self)
+	}
+	if ctx.Self.Labels["io.rancher.stack.name"] != "web" {
+		t.Errorf("self labels = %v", ctx.Self.Labels)
+	}
+}
+
+func TestPollReplacesDestination(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	client := newFakeClient()
+	dest := filepath.Join(dir, "out")
+	r := newTestRunner(client, Template{
+		Source: writeFile(t, filepath.Join(dir, "in.tmpl"), "{{range .Containers}}{{.Name}}\n{{end}}"),
+		Dest:   dest,
+	})
+
+	if err := r.poll(); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.Stat(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client.versions = []string{"2"}
+	client.containers = client.containers[:1]
+	if err := r.poll(); err != nil {
+		t.Fatal(err)
+	}
+	after, err := os.Stat(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if os.SameFile(before, after) {
+		t.Error("destination was rewritten in place instead of being replaced by a rename")
+	}
+	if got := readFile(t, dest); got != "web_web_1\n" {
+		t.Errorf("dest = %q", got)
+	}
+}
+
+func TestPollUpdatesOnlyOnChange(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	client := newFakeClient()
+	counter := filepath.Join(dir, "notified")
+	r := newTestRunner(client, Template{
+		Source:    writeFile(t, filepath.Join(dir, "in.tmpl"), "{{range .Containers}}{{.Name}}\n{{end}}"),
+		Dest:      filepath.Join(dir, "out"),
+		NotifyCmd: "echo x >> " + counter,
+	})
+
+	if err := r.poll(); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, filepath.Join(dir, "out")); got != "web_web_1\nweb_web_2\nweb_db_1\n" {
+		t.Errorf("dest = %q", got)
+	}
+
+	// a new version with the same content neither writes nor notifies
+	fi, _ := os.Stat(filepath.Join(dir, "out"))
+	client.versions = []string{"2"}
+	if err := r.poll(); err != nil {
+		t.Fatal(err)
+	}
+	fi2, _ := os.Stat(filepath.Join(dir, "out"))
+	if !os.SameFile(fi, fi2) {
+		t.Error("destination was rewritten with the same content")
+	}
+	if got := readFile(t, counter); got != "x\n" {
+		t.Errorf("notify command ran %d times, want 1", strings.Count(got, "x"))
+	}
+
+	// the same version isn't rendered again
+	client.versions = []string{"2"}
+	client.containers = client.containers[:1]
+	if err := r.poll(); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, filepath.Join(dir, "out")); got != "web_web_1\nweb_web_2\nweb_db_1\n" {
+		t.Errorf("dest changed without a new version: %q", got)
+	}
+}
+
+func TestWriteDestinationReplacesFile(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	dest := writeFile(t, filepath.Join(dir, "out"), "old\n")
+	before, _ := os.Stat(dest)
+
+	changed, err := writeDestination([]byte("new\n"), Template{Dest: dest})
+	if err != nil || !changed {
+		t.Fatalf("writeDestination = %v, %v", changed, err)
+	}
+	after, _ := os.Stat(dest)
+	if os.SameFile(before, after) {
+		t.Error("destination was modified in place instead of being replaced")
+	}
+	if got := readFile(t, dest); got != "new\n" {
+		t.Errorf("dest = %q", got)
+	}
+
+	// no staging files are left behind
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Errorf("found %d files in the destination directory, want 1", len(files))
+	}
+}
+
+func TestWriteDestinationCheckCmd(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	dest := writeFile(t, filepath.Join(dir, "out"), "old\n")
+	_, err := writeDestination([]byte("new\n"), Template{Dest: dest, CheckCmd: "grep -q valid {{staging}}"})
+	if err == nil {
+		t.Error("expected the check command to fail")
+	}
+	if got := readFile(t, dest); got != "old\n" {
+		t.Errorf("dest was updated despite the failed check: %q", got)
+	}
+
+	changed, err := writeDestination([]byte("valid\n"), Template{Dest: dest, CheckCmd: "grep -q valid {{staging}}"})
+	if err != nil || !changed {
+		t.Errorf("writeDestination = %v, %v", changed, err)
+	}
+}
+
+func TestWriteDestinationBackup(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	dest := filepath.Join(dir, "out")
+	if _, err := writeDestination([]byte("first\n"), Template{Dest: dest, Backup: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dest + ".bak"); !os.IsNotExist(err) {
+		t.Error("a backup was created for a new destination")
+	}
+
+	for _, content := range []string{"second\n", "third\n"} {
+		if _, err := writeDestination([]byte(content), Template{Dest: dest, Backup: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := readFile(t, dest+".bak"); got != "second\n" {
+		t.Errorf("backup = %q, want the previous content", got)
+	}
+}
+
+func TestWriteDestinationMode(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	mode := func(path string) os.FileMode {
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fi.Mode().Perm()
+	}
+
+	newFile := filepath.Join(dir, "new")
+	if _, err := writeDestination([]byte("x"), Template{Dest: newFile}); err != nil {
+		t.Fatal(err)
+	}
+	if m := mode(newFile); m != 0644 {
+		t.Errorf("new file mode = %o, want 644", m)
+	}
+
+	existing := writeFile(t, filepath.Join(dir, "existing"), "old")
+	os.Chmod(existing, 0640)
+	if _, err := writeDestination([]byte("new"), Template{Dest: existing}); err != nil {
+		t.Fatal(err)
+	}
+	if m := mode(existing); m != 0640 {
+		t.Errorf("existing file mode = %o, want 640", m)
+	}
+
+	if _, err := writeDestination([]byte("newer"), Template{Dest: existing, Mode: "0600", perm: 0600}); err != nil {
+		t.Fatal(err)
+	}
+	if m := mode(existing); m != 0600 {
+		t.Errorf("configured file mode = %o, want 600", m)
+	}
+}
+
+func TestProcessTemplate(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	partial := writeFile(t, filepath.Join(dir, "hosts.partial"), `{{define "host"}}{{.Name}}={{.Address}}{{end}}`)
+	writeFile(t, filepath.Join(dir, "footer.partial"), "# end")
+
+	tests := []struct {
+		name     string
+		source   string
+		template Template
+		want     string
+	}{
+		{"partials", `{{range .Hosts}}{{template "host" .}} {{end}}{{template "footer.partial"}}`,
+			Template{Partials: []string{partial, filepath.Join(dir, "footer.*")}}, "node1=192.168.0.1 node2=192.168.0.2 # end"},
+		{"delimiters", `{{ literal }} [[ .Self.Stack ]]`,
+			Template{LeftDelim: "[[", RightDelim: "]]"}, "{{ literal }} web"},
+		{"only-if match", `rendered`,
+			Template{OnlyIf: []string{".web", "@tier=frontend"}}, "rendered"},
+	}
+
+	for _, tt := range tests {
+		dest := filepath.Join(dir, tt.name+".out")
+		tmpl := tt.template
+		tmpl.Source = writeFile(t, filepath.Join(dir, tt.name+".tmpl"), tt.source)
+		tmpl.Dest = dest
+		r := newTestRunner(newFakeClient(), tmpl)
+
+		if err := r.poll(); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if got := readFile(t, dest); got != tt.want {
+			t.Errorf("%s: dest = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestProcessTemplateOnlyIf(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	dest := filepath.Join(dir, "out")
+	r := newTestRunner(newFakeClient(), Template{
+		Source: writeFile(t, filepath.Join(dir, "in.tmpl"), "rendered"),
+		Dest:   dest,
+		OnlyIf: []string{"@tier=backend"},
+	})
+	if err := r.poll(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dest); !os.IsNotExist(err) {
+		t.Error("template was rendered although no service matches")
+	}
+
+	r.Version = "init"
+	r.Config.Templates[0].OnlyIf = []string{"bad"}
+	if err := r.poll(); err == nil {
+		t.Error("expected an error for an invalid condition")
+	}
+}
+
+func TestProcessTemplateMultipleDests(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	counter := filepath.Join(dir, "notified")
+	dests := []string{filepath.Join(dir, "a"), filepath.Join(dir, "b")}
+	writeFile(t, dests[1], "web")
+
+	r := newTestRunner(newFakeClient(), Template{
+		Source:    writeFile(t, filepath.Join(dir, "in.tmpl"), "{{.Self.Stack}}"),
+		Dests:     dests,
+		NotifyCmd: "echo x >> " + counter,
+	})
+	ctx, _ := r.createContext()
+	summary := &cycleSummary{}
+	if err := r.processTemplate(ctx, newFuncMap(ctx), r.Config.Templates[0], summary); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, dest := range dests {
+		if got := readFile(t, dest); got != "web" {
+			t.Errorf("%s = %q", dest, got)
+		}
+	}
+	if want := dests[:1]; !reflect.DeepEqual(summary.Changed, want) {
+		t.Errorf("changed = %q, want %q", summary.Changed, want)
+	}
+	if want := []string{"echo x >> " + counter}; !reflect.DeepEqual(summary.Notified, want) {
+		t.Errorf("notified = %q, want %q", summary.Notified, want)
+	}
+	if got := readFile(t, counter); got != "x\n" {
+		t.Errorf("notify command ran %d times, want 1", strings.Count(got, "x"))
+	}
+}
+
+func TestProcessTemplateErrors(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name            string
+		source          string
+		tolerateMissing bool
+		wantErr         string
+	}{
+		{"syntax", "line one\n{{ .Services", false, "broken.tmpl' at line 2 '{{ .Services'"},
+		{"syntax tolerated", "line one\n{{ .Services", true, "Could not parse template"},
+		{"missing", "{{.GetService \"missing\"}}", false, "could not find service"},
+		{"missing tolerated", "{{.GetService \"missing\"}}", true, ""},
+	}
+
+	for _, tt := range tests {
+		dest := filepath.Join(dir, "out")
+		os.Remove(dest)
+		r := newTestRunner(newFakeClient(), Template{
+			Source: writeFile(t, filepath.Join(dir, "broken.tmpl"), tt.source),
+			Dest:   dest,
+		})
+		r.Config.TolerateMissing = tt.tolerateMissing
+		ctx, _ := r.createContext()
+
+		err := r.processTemplate(ctx, newFuncMap(ctx), r.Config.Templates[0], &cycleSummary{})
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", tt.name, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: error = %v, want it to contain %q", tt.name, err, tt.wantErr)
+		}
+		if _, err := os.Stat(dest); !os.IsNotExist(err) {
+			t.Errorf("%s: destination was written", tt.name)
+		}
+	}
+
+	r := newTestRunner(newFakeClient(), Template{Source: filepath.Join(dir, "missing.tmpl")})
+	if err := r.poll(); err == nil || !strings.Contains(err.Error(), "missing.tmpl' is missing") {
+		t.Errorf("missing template: error = %v", err)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	dest := filepath.Join(dir, "out")
+	r := newTestRunner(newFakeClient(),
+		Template{Source: writeFile(t, filepath.Join(dir, "good.tmpl"), "stack {{.Self.Stack}}\n"), Dest: dest},
+		Template{Source: writeFile(t, filepath.Join(dir, "bad.tmpl"), "{{ .Broken"), Dest: dest},
+	)
+	r.Config.DryRun = true
+
+	var err error
+	out := captureStdout(t, func() { err = r.Run() })
+	if err == nil || err.Error() != "1 of 2 templates failed" {
+		t.Errorf("Run() = %v", err)
+	}
+	if want := "==> " + dest + " <==\nstack web\n"; out != want {
+		t.Errorf("output = %q, want %q", out, want)
+	}
+	if _, err := os.Stat(dest); !os.IsNotExist(err) {
+		t.Error("destination was written in dry-run mode")
+	}
+}
+
+func TestOneTime(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	client := newFakeClient()
+	dest := filepath.Join(dir, "out")
+	r := newTestRunner(client, Template{Source: writeFile(t, filepath.Join(dir, "in.tmpl"), "x"), Dest: dest})
+	r.Config.OneTime = true
+
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if client.versionCalls != 1 {
+		t.Errorf("Metadata version fetched %d times, want 1", client.versionCalls)
+	}
+	if got := readFile(t, dest); got != "x" {
+		t.Errorf("dest = %q", got)
+	}
+}
+
+func TestRunnerMetrics(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	client := newFakeClient()
+	r := newTestRunner(client, Template{
+		Source: writeFile(t, filepath.Join(dir, "in.tmpl"), "x"),
+		Dest:   filepath.Join(dir, "out"),
+	})
+	r.Config.OneTime = true
+
+	// a one-time run is a cycle with a change
+	if err := r.Run(); err != nil {
+		t.Fatal(err)
+	}
+	m := r.Metrics.snapshot()
+	if m.RenderCycles != 1 || m.TemplatesChanged != 1 || m.Errors != 0 || m.LastSuccess.IsZero() {
+		t.Errorf("metrics after a one-time run = %+v", &m)
+	}
+
+	// a poll without a new version isn't a render cycle but still a success
+	r.Metrics.LastSuccess = time.Time{}
+	if err := r.poll(); err != nil {
+		t.Fatal(err)
+	}
+	m = r.Metrics.snapshot()
+	if m.RenderCycles != 1 || m.TemplatesChanged != 1 || m.LastSuccess.IsZero() {
+		t.Errorf("metrics after a poll without change = %+v", &m)
+	}
+}
+
+func TestIgnoreFields(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	client := newFakeClient()
+	dest := filepath.Join(dir, "out")
+	r := newTestRunner(client, Template{
+		Source: writeFile(t, filepath.Join(dir, "in.tmpl"), "{{range .Containers}}{{.Name}} {{.Health}}\n{{end}}"),
+		Dest:   dest,
+	})
+	r.Config.IgnoreFields = []string{"Health"}
+
+	if err := r.poll(); err != nil {
+		t.Fatal(err)
+	}
+	before := readFile(t, dest)
+
+	client.versions = []string{"2"}
+	client.containers[0].HealthState = "unhealthy"
+	if err := r.poll(); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, dest); got != before {
+		t.Errorf("dest was rendered after a change of an ignored field: %q", got)
+	}
+
+	client.versions = []string{"3"}
+	client.containers[0].State = "stopped"
+	if err := r.poll(); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, dest); !strings.Contains(got, "web_web_1 unhealthy") {
+		t.Errorf("dest wasn't rendered after a change of another field: %q", got)
+	}
+}
+
+func TestExecuteTemplateTimeout(t *testing.T) {
+	funcs := template.FuncMap{"slow": func() string { time.Sleep(time.Second); return "done" }}
+	tmpl := template.Must(template.New("slow").Funcs(funcs).Parse("{{slow}}"))
+
+	start := time.Now()
+	_, err := executeTemplate(tmpl, &TemplateContext{}, 50*time.Millisecond)
+	var timeout renderTimeoutError
+	if !errors.As(err, &timeout) {
+		t.Errorf("expected a renderTimeoutError, got %v", err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("executeTemplate returned after %v", d)
+	}
+
+	out, err := executeTemplate(tmpl, &TemplateContext{}, 0)
+	if err != nil || string(out) != "done" {
+		t.Errorf("executeTemplate without timeout = %q, %v", out, err)
+	}
+}
+
+func TestNotifyTimeout(t *testing.T) {
+	start := time.Now()
+	err := notify("sleep 5", false, 100*time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("notify = %v, want a timeout", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("notify returned after %v", d)
+	}
+
+	if err := notify("true", false, time.Second); err != nil {
+		t.Errorf("notify(true) = %v", err)
+	}
+}
+
+func TestNotifyWithRetry(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	// fails the first two times it runs
+	counter := filepath.Join(dir, "count")
+	cmd := fmt.Sprintf("echo x >> %s; [ $(wc -l < %s) -ge 3 ]", counter, counter)
+
+	r := newTestRunner(newFakeClient())
+	tmpl := Template{NotifyCmd: cmd, NotifyTimeout: 10, NotifyAttempts: 3, NotifyRetryDelay: 1}
+	if err := r.notifyWithRetry(tmpl); err != nil {
+		t.Errorf("notifyWithRetry = %v", err)
+	}
+	if got := strings.Count(readFile(t, counter), "x"); got != 3 {
+		t.Errorf("notify command ran %d times, want 3", got)
+	}
+	if r.Metrics.NotifyRuns != 3 {
+		t.Errorf("NotifyRuns = %d, want 3", r.Metrics.NotifyRuns)
+	}
+
+	os.Remove(counter)
+	tmpl.NotifyAttempts = 1
+	if err := r.notifyWithRetry(tmpl); err == nil {
+		t.Error("expected the single attempt to fail")
+	}
+}
+
+func TestSignalProcess(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	child := exec.Command("sleep", "10")
+	if err := child.Start(); err != nil {
+		t.Fatal(err)
+	}
+	pidfile := writeFile(t, filepath.Join(dir, "pid"), fmt.Sprintf("%d\n", child.Process.Pid))
+
+	if err := signalProcess(pidfile, syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	err := child.Wait()
+	status, ok := child.ProcessState.Sys().(syscall.WaitStatus)
+	if err == nil || !ok || !status.Signaled() || status.Signal() != syscall.SIGTERM {
+		t.Errorf("child exited with %v, want SIGTERM", err)
+	}
+
+	writeFile(t, pidfile, "not a pid")
+	if err := signalProcess(pidfile, syscall.SIGHUP); err == nil {
+		t.Error("expected an error for an invalid pidfile")
+	}
+}
+
+func TestWaitForChange(t *testing.T) {
+	client := newFakeClient()
+	r := newTestRunner(client)
+	r.Version = "1"
+
+	// the fake answers at once with the same version like a Metadata
+	// service without long-polling
+	if err := r.waitForChange(); err == nil {
+		t.Error("expected an error for a service without watch support")
+	}
+	client.versions = []string{"2"}
+	if err := r.waitForChange(); err != nil {
+		t.Errorf("waitForChange with a new version = %v", err)
+	}
+}
+
+// fakeAfter replaces time.After with channels that fire at once and counts
+// how often it was called
+type fakeAfter struct {
+	calls int
+}
+
+func (f *fakeAfter) after(time.Duration) <-chan time.Time {
+	f.calls++
+	ch := make(chan time.Time, 1)
+	ch <- time.Now()
+	return ch
+}
+
+func TestWaitForQuiet(t *testing.T) {
+	client := newFakeClient()
+	client.versions = []string{"3", "4", "4"}
+	r := newTestRunner(client)
+	r.Config.Debounce = 1
+	r.Config.MaxInterval = 10
+	timer := &fakeAfter{}
+	r.after = timer.after
+
+	version, err := r.waitForQuiet("2")
+	if err != nil || version != "4" {
+		t.Errorf("waitForQuiet = %q, %v; want the latest version", version, err)
+	}
+	if client.versionCalls != 3 || timer.calls != 3 {
+		t.Errorf("Metadata version fetched %d times after %d waits, want 3", client.versionCalls, timer.calls)
+	}
+}
+
+func TestWaitForQuietQuit(t *testing.T) {
+	r := newTestRunner(newFakeClient())
+	r.Config.Debounce = 1
+	r.Config.MaxInterval = 10
+	r.after = func(time.Duration) <-chan time.Time { return nil }
+	r.quitChan = make(chan os.Signal, 1)
+	r.quitChan <- syscall.SIGTERM
+
+	if _, err := r.waitForQuiet("2"); err != errQuit {
+		t.Errorf("waitForQuiet = %v, want errQuit", err)
+	}
+	select {
+	case <-r.quitChan:
+	default:
+		t.Error("the signal wasn't left for Run")
+	}
+}
+
+func TestDebounceRendersOnce(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	client := newFakeClient()
+	counter := filepath.Join(dir, "notified")
+	r := newTestRunner(client, Template{
+		Source:    writeFile(t, filepath.Join(dir, "in.tmpl"), "{{len .Containers}}"),
+		Dest:      filepath.Join(dir, "out"),
+		NotifyCmd: "echo x >> " + counter,
+	})
+	r.Config.Debounce = 1
+	r.Config.MaxInterval = 10
+	r.after = (&fakeAfter{}).after
+
+	if err := r.poll(); err != nil {
+		t.Fatal(err)
+	}
+
+	// three changes in a row, the last version is seen again once the
+	// Metadata is quiet
+	client.versions = []string{"2", "3", "4", "4"}
+	client.containers = client.containers[:1]
+	if err := r.poll(); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Count(readFile(t, counter), "x"); got != 2 {
+		t.Errorf("rendered %d times, want once initially and once for the changes", got)
+	}
+	if r.Version != "4" {
+		t.Errorf("Version = %q, want the latest version", r.Version)
+	}
+}
+
+func TestDumpContext(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	r := newTestRunner(newFakeClient())
+	path := filepath.Join(dir, "context.json")
+	if err := r.DumpContext(path); err != nil {
+		t.Fatal(err)
+	}
+
+	var ctx TemplateContext
+	if err := json.Unmarshal([]byte(readFile(t, path)), &ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(ctx.Containers) != 3 || ctx.Self.ContainerName != "web_web_1" {
+		t.Errorf("dumped context = %+v", ctx)
+	}
+}
+
+func TestMetadataURL(t *testing.T) {
+	tests := []struct {
+		base, version string
+		want          string
+	}{
+		{"http://rancher-metadata", "latest", "http://rancher-metadata/latest"},
+		{"http://rancher-metadata/", "2015-12-19", "http://rancher-metadata/2015-12-19"},
+		{"https://proxy:8443/metadata", "latest", "https://proxy:8443/metadata/latest"},
+	}
+	for _, tt := range tests {
+		got, err := metadataURL(tt.base, tt.version)
+		if err != nil || got != tt.want {
+			t.Errorf("metadataURL(%q, %q) = %q, %v; want %q", tt.base, tt.version, got, err, tt.want)
+		}
+	}
+
+	if _, err := metadataURL("http://[::1", "latest"); err == nil {
+		t.Error("expected an error for an invalid URL")
+	}
+}
+
+func TestParseServicePorts(t *testing.T) {
+	got := parseServicePorts([]string{"80:8080/tcp", "127.0.0.1:53:53/udp", "9090/tcp", "invalid"})
+	want := []ServicePort{
+		{PublicPort: "80", InternalPort: "8080", Protocol: "tcp"},
+		{BindAddress: "127.0.0.1", PublicPort: "53", InternalPort: "53", Protocol: "udp"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseServicePorts = %+v, want %+v", got, want)
+	}
+}
+
+func TestParseContainerPorts(t *testing.T) {
+	got := parseContainerPorts([]string{"0.0.0.0:80:8080/tcp", "53:53/udp", "9090/tcp", "invalid", "1:2:3:4/tcp"})
+	want := []PortBinding{
+		{PrivatePort: "8080", PublicPort: "80", Protocol: "tcp", IP: "0.0.0.0"},
+		{PrivatePort: "53", PublicPort: "53", Protocol: "udp"},
+		{PrivatePort: "9090", Protocol: "tcp"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseContainerPorts = %+v, want %+v", got, want)
+	}
+}
+
+func TestServiceLinks(t *testing.T) {
+	got := serviceLinks(map[string]string{"db": "db", "other/api": "api", "cache": "redis"}, "web")
+	if want := []string{"api.other", "cache.web", "db.web"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("serviceLinks = %q, want %q", got, want)
+	}
+}
+
+func TestPublicEndpoints(t *testing.T) {
+	ports := []ServicePort{
+		{PublicPort: "80", InternalPort: "8080", Protocol: "tcp"},
+		{BindAddress: "10.1.1.1", PublicPort: "53", InternalPort: "53", Protocol: "udp"},
+	}
+	containers := []Container{
+		{Host: Host{Address: "192.168.0.1"}},
+		{Host: Host{Address: "192.168.0.1"}},
+		{Host: Host{Address: "192.168.0.2"}},
+		{},
+	}
+	want := []PublicEndpoint{
+		{"192.168.0.1", "80", "tcp"},
+		{"192.168.0.2", "80", "tcp"},
+		{"10.1.1.1", "53", "udp"},
+	}
+	if got := publicEndpoints(ports, containers); !reflect.DeepEqual(got, want) {
+		t.Errorf("publicEndpoints = %+v, want %+v", got, want)
+	}
+}
+
+func TestSourceLine(t *testing.T) {
+	source := []byte("first\n  {{ .Broken }}\nlast")
+	tests := []struct {
+		err  string
+		want string
+	}{
+		{"template: in.tmpl:2:5: executing", " at line 2 '{{ .Broken }}'"},
+		{"template: other.tmpl:2:5: executing", ""},
+		{"template: in.tmpl:9: unexpected EOF", ""},
+		{"some other error", ""},
+	}
+	for _, tt := range tests {
+		if got := sourceLine(errors.New(tt.err), "in.tmpl", source); got != tt.want {
+			t.Errorf("sourceLine(%q) = %q, want %q", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestStructuredLogging(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	client := newFakeClient()
+	source := writeFile(t, filepath.Join(dir, "in.tmpl"), "{{.Self.Stack}}")
+	dest := filepath.Join(dir, "out")
+	r := newTestRunner(client, Template{Source: source, Dest: dest})
+
+	out := captureLog(log.DebugLevel, func() {
+		if err := r.poll(); err != nil {
+			t.Error(err)
+		}
+	})
+	for _, want := range []string{
+		`level=debug msg="Checked Metadata version" change=true new=1 old=init`,
+		`level=debug msg="Rendered template" duration=`,
+		fmt.Sprintf("template=%q", source),
+		fmt.Sprintf(`level=info msg="Destination file has been updated" change=true dest=%q`, dest),
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("debug log doesn't contain %q:\n%s", want, out)
+		}
+	}
+
+	// debug messages are dropped at the info level
+	client.versions = []string{"2"}
+	writeFile(t, source, "{{.Self.ContainerName}}")
+	out = captureLog(log.InfoLevel, func() {
+		if err := r.poll(); err != nil {
+			t.Error(err)
+		}
+	})
+	if strings.Contains(out, "level=debug") {
+		t.Errorf("info log contains debug messages:\n%s", out)
+	}
+	if want := `msg="Destination file has been updated"`; !strings.Contains(out, want) {
+		t.Errorf("info log doesn't contain %q:\n%s", want, out)
+	}
+}
+
+func TestCycleSummaryLog(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	client := newFakeClient()
+	dest := filepath.Join(dir, "out")
+	broken := filepath.Join(dir, "b.tmpl")
+	r := newTestRunner(client,
+		Template{Source: writeFile(t, filepath.Join(dir, "a.tmpl"), "{{.Self.Stack}}"), Dest: dest, NotifyCmd: "true"},
+		Template{Source: writeFile(t, broken, "{{.Self.Stack}}"), Dest: writeFile(t, filepath.Join(dir, "same"), "web")},
+	)
+
+	out := captureLog(log.InfoLevel, func() {
+		if err := r.poll(); err != nil {
+			t.Error(err)
+		}
+	})
+	if want := fmt.Sprintf(`msg="Cycle complete" changed=[%s] errors=0 notified=[true]`, dest); !strings.Contains(out, want) {
+		t.Errorf("log doesn't contain %q:\n%s", want, out)
+	}
+
+	client.versions = []string{"2"}
+	writeFile(t, broken, "{{ .Broken")
+	out = captureLog(log.InfoLevel, func() {
+		if err := r.poll(); err == nil {
+			t.Error("expected an error for the broken template")
+		}
+	})
+	if want := `msg="Cycle complete" changed=[] errors=1 notified=[]`; !strings.Contains(out, want) {
+		t.Errorf("log doesn't contain %q:\n%s", want, out)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// label selector operators
+const (
+	opExists       = ""
+	opEquals       = "="
+	opNotEquals    = "!="
+	opGlob         = "~="
+	opGreater      = ">"
+	opGreaterEqual = ">="
+	opLess         = "<"
+	opLessEqual    = "<="
+)
+
+// operators ordered so that the longer ones are tried first
+var selectorOps = []string{opGreaterEqual, opLessEqual, opNotEquals, opGlob, opGreater, opLess, opEquals}
+
+// labelSelector is a parsed label selector in the form '@label-key',
+// '@label-key=label-value', '@label-key!=label-value', a glob pattern like
+// '@label-key~=web-*' or a numeric comparison like '@label-key>=number'.
+type labelSelector struct {
+	Key           string
+	Op            string
+	Value         string
+	CaseSensitive bool
+
+	number float64
+}
+
+// parses a label selector and appends it to the given slice.
+func parseLabelSelector(f string, caseSensitive bool, selectors *[]labelSelector) error {
+	if len(f) < 2 {
+		return fmt.Errorf("empty label selector '%s'", f)
+	}
+
+	body := f[1:len(f)]
+	sel := labelSelector{Key: body, Op: opExists, CaseSensitive: caseSensitive}
+	if i := strings.IndexAny(body, "=!~<>"); i >= 0 {
+		sel.Key = body[:i]
+		for _, op := range selectorOps {
+			if strings.HasPrefix(body[i:], op) {
+				sel.Op = op
+				sel.Value = body[i+len(op):]
+				break
+			}
+		}
+		// the value may contain further '=' characters
+		if sel.Op == opExists {
+			return fmt.Errorf("malformed label selector '%s'", f)
+		}
+	}
+	if len(sel.Key) == 0 {
+		return fmt.Errorf("malformed label selector '%s'", f)
+	}
+
+	switch sel.Op {
+	case opGreater, opGreaterEqual, opLess, opLessEqual:
+		n, err := strconv.ParseFloat(sel.Value, 64)
+		if err != nil {
+			return fmt.Errorf("non-numeric value in label selector '%s'", f)
+		}
+		sel.number = n
+	case opGlob:
+		if _, err := path.Match(sel.Value, ""); err != nil {
+			return fmt.Errorf("malformed glob pattern in label selector '%s'", f)
+		}
+	}
+
+	*selectors = append(*selectors, sel)
+	return nil
+}
+
+// returns true if the labels satisfy the selector. A negated selector
+// matches when the label is absent or its value doesn't match. Numeric
+// comparisons don't match labels with non-numeric values.
+func (s labelSelector) Match(labels LabelMap) bool {
+	switch s.Op {
+	case opExists:
+		return labels.Exists(s.Key)
+	case opEquals:
+		return labels.Exists(s.Key) && labelValueMatches(labels.GetValue(s.Key), s.Value, s.CaseSensitive)
+	case opNotEquals:
+		return !labels.Exists(s.Key) || !labelValueMatches(labels.GetValue(s.Key), s.Value, s.CaseSensitive)
+	case opGlob:
+		return labels.Exists(s.Key) && globMatches(labels.GetValue(s.Key), s.Value, s.CaseSensitive)
+	}
+
+	n, err := strconv.ParseFloat(strings.TrimSpace(labels.GetValue(s.Key)), 64)
+	if err != nil {
+		return false
+	}
+	switch s.Op {
+	case opGreater:
+		return n > s.number
+	case opGreaterEqual:
+		return n >= s.number
+	case opLess:
+		return n < s.number
+	case opLessEqual:
+		return n <= s.number
+	}
+	return false
+}
+
+// returns true if the labels satisfy all of the selectors.
+func matchLabelSelectors(labels LabelMap, selectors []labelSelector) bool {
+	for _, s := range selectors {
+		if !s.Match(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+// returns true if the value equals the pattern or one of its alternatives
+// separated by '|', or if the pattern is a regex matching the whole value.
+// Unless caseSensitive is set the values are compared case-insensitively.
+func labelValueMatches(value, pattern string, caseSensitive bool) bool {
+	for _, alt := range splitAlternatives(pattern) {
+		if value == alt || (!caseSensitive && strings.EqualFold(value, alt)) {
+			return true
+		}
+	}
+	rx, err := regexp.Compile("^(?:" + pattern + ")$")
+	return err == nil && rx.MatchString(value)
+}
+
+// returns true if the value matches the glob pattern as in path.Match.
+// Unless caseSensitive is set the values are compared case-insensitively.
+func globMatches(value, pattern string, caseSensitive bool) bool {
+	if !caseSensitive {
+		value, pattern = strings.ToLower(value), strings.ToLower(pattern)
+	}
+	ok, err := path.Match(pattern, value)
+	return err == nil && ok
+}
+
+// splits a pattern on the '|' characters that aren't escaped with a
+// backslash. Escaped ones are kept as literal '|'.
+func splitAlternatives(pattern string) []string {
+	alts := make([]string, 0, 1)
+	var cur []byte
+	for i := 0; i < len(pattern); i++ {
+		switch {
+		case pattern[i] == '\\' && i+1 < len(pattern) && pattern[i+1] == '|':
+			cur = append(cur, '|')
+			i++
+		case pattern[i] == '|':
+			alts = append(alts, string(cur))
+			cur = cur[:0]
+		default:
+			cur = append(cur, pattern[i])
+		}
+	}
+	return append(alts, string(cur))
+}
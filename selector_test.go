@@ -0,0 +1,191 @@
+package main
+
+import "testing"
+
+func TestParseLabelSelector(t *testing.T) {
+	tests := []struct {
+		selector string
+		key      string
+		op       string
+		value    string
+		wantErr  bool
+	}{
+		{"@role=web", "role", opEquals, "web", false},
+		{"@role!=db", "role", opNotEquals, "db", false},
+		{"@monitored", "monitored", opExists, "", false},
+		{"@weight>=5", "weight", opGreaterEqual, "5", false},
+		{"@weight<=5", "weight", opLessEqual, "5", false},
+		{"@weight>5", "weight", opGreater, "5", false},
+		{"@weight<5", "weight", opLess, "5", false},
+		{"@name~=web-*", "name", opGlob, "web-*", false},
+		{"@token=YWJj=", "token", opEquals, "YWJj=", false},
+		{"@", "", "", "", true},
+		{"", "", "", "", true},
+		{"@=", "", "", "", true},
+		{"@=value", "", "", "", true},
+		{"@weight>=heavy", "", "", "", true},
+		{"@name~=[", "", "", "", true},
+	}
+
+	for _, tt := range tests {
+		var selectors []labelSelector
+		err := parseLabelSelector(tt.selector, false, &selectors)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseLabelSelector(%q): expected an error", tt.selector)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseLabelSelector(%q): unexpected error: %v", tt.selector, err)
+			continue
+		}
+		if len(selectors) != 1 {
+			t.Fatalf("parseLabelSelector(%q): got %d selectors", tt.selector, len(selectors))
+		}
+		s := selectors[0]
+		if s.Key != tt.key || s.Op != tt.op || s.Value != tt.value {
+			t.Errorf("parseLabelSelector(%q) = {%q %q %q}, want {%q %q %q}",
+				tt.selector, s.Key, s.Op, s.Value, tt.key, tt.op, tt.value)
+		}
+	}
+}
+
+func TestLabelSelectorMatch(t *testing.T) {
+	tests := []struct {
+		selector string
+		labels   LabelMap
+		want     bool
+	}{
+		// regex patterns are anchored
+		{"@role=web", LabelMap{"role": "web"}, true},
+		{"@role=web", LabelMap{"role": "webhook"}, false},
+		{"@role=web.*", LabelMap{"role": "webhook"}, true},
+		{"@role=web", LabelMap{"role": "WEB"}, true},
+		{"@role=web", LabelMap{}, false},
+
+		{"@city=МОСКВА", LabelMap{"city": "москва"}, true},
+		{"@city=αθηνα", LabelMap{"city": "ΑΘΗΝΑ"}, true},
+		{"@city=москва", LabelMap{"city": "ΑΘΗΝΑ"}, false},
+
+		// alternatives
+		{"@env=prod|staging", LabelMap{"env": "prod"}, true},
+		{"@env=prod|staging", LabelMap{"env": "staging"}, true},
+		{"@env=prod|staging", LabelMap{"env": "dev"}, false},
+		{`@sep=a\|b`, LabelMap{"sep": "a|b"}, true},
+		{`@sep=a\|b`, LabelMap{"sep": "a"}, false},
+
+		// negation
+		{"@tier!=db", LabelMap{"tier": "web"}, true},
+		{"@tier!=db", LabelMap{}, true},
+		{"@tier!=db", LabelMap{"tier": "db"}, false},
+
+		// presence
+		{"@monitored", LabelMap{"monitored": ""}, true},
+		{"@monitored", LabelMap{"other": "x"}, false},
+
+		// numeric comparisons
+		{"@weight>=5", LabelMap{"weight": "5"}, true},
+		{"@weight>=5", LabelMap{"weight": "4"}, false},
+		{"@weight>5", LabelMap{"weight": "5"}, false},
+		{"@weight<5", LabelMap{"weight": "4.5"}, true},
+		{"@weight<=5", LabelMap{"weight": " 5 "}, true},
+		{"@weight>=5", LabelMap{"weight": "heavy"}, false},
+		{"@weight>=5", LabelMap{}, false},
+
+		// '=' in values
+		{"@token=YWJj=", LabelMap{"token": "YWJj="}, true},
+
+		// globs
+		{"@name~=web-*", LabelMap{"name": "web-1"}, true},
+		{"@name~=web-*", LabelMap{"name": "api-1"}, false},
+		{"@name~=web-?", LabelMap{"name": "WEB-2"}, true},
+		{"@name~=web-*", LabelMap{}, false},
+	}
+
+	for _, tt := range tests {
+		var selectors []labelSelector
+		if err := parseLabelSelector(tt.selector, false, &selectors); err != nil {
+			t.Fatalf("parseLabelSelector(%q): %v", tt.selector, err)
+		}
+		if got := selectors[0].Match(tt.labels); got != tt.want {
+			t.Errorf("%q matching %v = %v, want %v", tt.selector, tt.labels, got, tt.want)
+		}
+	}
+}
+
+func TestLabelSelectorCaseSensitive(t *testing.T) {
+	labels := LabelMap{"tier": "Web"}
+	tests := []struct {
+		selector      string
+		caseSensitive bool
+		want          bool
+	}{
+		{"@tier=web", false, true},
+		{"@tier=web", true, false},
+		{"@tier=Web", true, true},
+		{"@tier~=w*", false, true},
+		{"@tier~=w*", true, false},
+	}
+
+	for _, tt := range tests {
+		var selectors []labelSelector
+		if err := parseLabelSelector(tt.selector, tt.caseSensitive, &selectors); err != nil {
+			t.Fatalf("parseLabelSelector(%q): %v", tt.selector, err)
+		}
+		if got := selectors[0].Match(labels); got != tt.want {
+			t.Errorf("%q (case-sensitive %v) = %v, want %v", tt.selector, tt.caseSensitive, got, tt.want)
+		}
+	}
+}
+
+func TestMatchLabelSelectors(t *testing.T) {
+	var selectors []labelSelector
+	for _, s := range []string{"@env=prod", "@tier!=db"} {
+		if err := parseLabelSelector(s, false, &selectors); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		labels LabelMap
+		want   bool
+	}{
+		{LabelMap{"env": "prod", "tier": "web"}, true},
+		{LabelMap{"env": "prod"}, true},
+		{LabelMap{"env": "prod", "tier": "db"}, false},
+		{LabelMap{"env": "dev", "tier": "web"}, false},
+	}
+
+	for _, tt := range tests {
+		if got := matchLabelSelectors(tt.labels, selectors); got != tt.want {
+			t.Errorf("matchLabelSelectors(%v) = %v, want %v", tt.labels, got, tt.want)
+		}
+	}
+}
+
+func TestSplitAlternatives(t *testing.T) {
+	tests := []struct {
+		pattern string
+		want    []string
+	}{
+		{"prod", []string{"prod"}},
+		{"prod|staging", []string{"prod", "staging"}},
+		{`a\|b|c`, []string{"a|b", "c"}},
+		{"", []string{""}},
+	}
+
+	for _, tt := range tests {
+		got := splitAlternatives(tt.pattern)
+		if len(got) != len(tt.want) {
+			t.Errorf("splitAlternatives(%q) = %q, want %q", tt.pattern, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("splitAlternatives(%q) = %q, want %q", tt.pattern, got, tt.want)
+				break
+			}
+		}
+	}
+}
@@ -2,8 +2,14 @@ package main
 
 import (
 	"fmt"
+	"net"
+	"path"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+
+	log "github.com/Sirupsen/logrus"
 )
 
 type NotFoundError struct {
@@ -19,6 +25,20 @@ type TemplateContext struct {
 	Containers []Container
 	Hosts      []Host
 	Self       Self
+
+	// label designating the primary container of a service
+	primaryLabel string
+	// compare names and label values case-sensitively
+	caseSensitive bool
+}
+
+// returns true if the names are equal, case-insensitively unless the
+// context is case-sensitive.
+func (c *TemplateContext) equal(a, b string) bool {
+	if c.caseSensitive {
+		return a == b
+	}
+	return strings.EqualFold(a, b)
 }
 
 // GetHost returns the Host with the given UUID. If the argument is omitted
@@ -33,7 +53,7 @@ func (c *TemplateContext) GetHost(v ...string) (Host, error) {
 	}
 
 	for _, h := range c.Hosts {
-		if strings.EqualFold(uuid, h.UUID) {
+		if c.equal(uuid, h.UUID) {
 			return h, nil
 		}
 	}
@@ -41,6 +61,71 @@ func (c *TemplateContext) GetHost(v ...string) (Host, error) {
 	return Host{}, NotFoundError{"(host) could not find host by UUID: " + uuid}
 }
 
+// GetSelf returns the container running this application together with its
+// host and service. It fails with the first lookup error encountered.
+func (c *TemplateContext) GetSelf() (SelfObjects, error) {
+	cnt, err := c.GetContainer()
+	if err != nil {
+		return SelfObjects{}, err
+	}
+	h, err := c.GetHost()
+	if err != nil {
+		return SelfObjects{}, err
+	}
+	s, err := c.GetService()
+	if err != nil {
+		return SelfObjects{}, err
+	}
+
+	return SelfObjects{Container: cnt, Host: h, Service: s}, nil
+}
+
+// GetSelfContainer returns the container running this application.
+func (c *TemplateContext) GetSelfContainer() (Container, error) {
+	return c.GetContainer()
+}
+
+// GetSelfHost returns the host of the container running this application.
+func (c *TemplateContext) GetSelfHost() (Host, error) {
+	return c.GetHost()
+}
+
+// GetSelfService returns the service of the container running this application.
+func (c *TemplateContext) GetSelfService() (Service, error) {
+	return c.GetService()
+}
+
+// GetHostByName returns the Host with the given name or hostname.
+func (c *TemplateContext) GetHostByName(name string) (Host, error) {
+	for _, h := range c.Hosts {
+		if c.equal(name, h.Name) || c.equal(name, h.Hostname) {
+			return h, nil
+		}
+	}
+
+	return Host{}, NotFoundError{"(host) could not find host by name: " + name}
+}
+
+// GetContainer returns the container with the given name. If the argument
+// is omitted the current container is returned.
+func (c *TemplateContext) GetContainer(v ...string) (Container, error) {
+	name := ""
+	if len(v) > 0 {
+		name = v[0]
+	}
+	if name == "" {
+		name = c.Self.ContainerName
+	}
+
+	for _, cnt := range c.Containers {
+		if c.equal(name, cnt.Name) {
+			return cnt, nil
+		}
+	}
+
+	return Container{}, NotFoundError{"(container) could not find container by name: " + name}
+}
+
 // GetService returns the service matching the given name.
 // It expects a string in the form 'service-name[.stack-name]'.
 // If the argument is an empty string it returns the service of the current container.
@@ -67,58 +152,573 @@ func (c *TemplateContext) GetService(v ...string) (Service, error) {
 		}
 	}
 
+	matches := make([]Service, 0, 1)
 	for _, s := range c.Services {
-		if strings.EqualFold(s.Name, service) && strings.EqualFold(s.Stack, stack) {
+		if c.equal(s.Name, service) && c.equal(s.Stack, stack) {
+			matches = append(matches, s)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return Service{}, NotFoundError{"(service) could not find service by identifier: " + identifier}
+	case 1:
+		return matches[0], nil
+	default:
+		return Service{}, fmt.Errorf("(service) ambiguous identifier '%s' matches %d services", identifier, len(matches))
+	}
+}
+
+// TryGetHost works like GetHost but returns nil instead of an error if the
+// host doesn't exist.
+func (c *TemplateContext) TryGetHost(v ...string) *Host {
+	h, err := c.GetHost(v...)
+	if err != nil {
+		return nil
+	}
+	return &h
+}
+
+// TryGetContainer works like GetContainer but returns nil instead of an
+// error if the container doesn't exist.
+func (c *TemplateContext) TryGetContainer(v ...string) *Container {
+	cnt, err := c.GetContainer(v...)
+	if err != nil {
+		return nil
+	}
+	return &cnt
+}
+
+// TryGetService works like GetService but returns nil instead of an error
+// if the service doesn't exist or the identifier is invalid.
+func (c *TemplateContext) TryGetService(v ...string) *Service {
+	s, err := c.GetService(v...)
+	if err != nil {
+		return nil
+	}
+	return &s
+}
+
+// GetServiceByUUID returns the service with the given UUID.
+func (c *TemplateContext) GetServiceByUUID(uuid string) (Service, error) {
+	for _, s := range c.Services {
+		if strings.EqualFold(uuid, s.UUID) {
 			return s, nil
 		}
 	}
 
-	return Service{}, NotFoundError{"(service) could not find service by identifier: " + identifier}
+	return Service{}, NotFoundError{"(service) could not find service by UUID: " + uuid}
+}
+
+// GetServiceByContainer returns the service of the container with the given
+// name. If the argument is omitted the service of the current container is
+// returned.
+func (c *TemplateContext) GetServiceByContainer(v ...string) (Service, error) {
+	cnt, err := c.GetContainer(v...)
+	if err != nil {
+		return Service{}, err
+	}
+
+	for _, s := range c.Services {
+		if c.equal(s.Name, cnt.Service) && c.equal(s.Stack, cnt.Stack) {
+			return s, nil
+		}
+	}
+
+	return Service{}, NotFoundError{"(service) could not find service of container: " + cnt.Name}
+}
+
+// GetContainerPorts returns the ports of the container with the given name.
+// If the argument is omitted the ports of the current container are returned.
+func (c *TemplateContext) GetContainerPorts(v ...string) ([]PortBinding, error) {
+	cnt, err := c.GetContainer(v...)
+	if err != nil {
+		return nil, err
+	}
+
+	return cnt.Ports, nil
+}
+
+// GetContainerByLabel returns the only container that has the label with a
+// value matching the given value like a label selector does. It fails if
+// there is no such container or more than one.
+func (c *TemplateContext) GetContainerByLabel(key, value string) (Container, error) {
+	matches := make([]Container, 0, 1)
+	for _, cnt := range c.Containers {
+		if cnt.Labels.Exists(key) && labelValueMatches(cnt.Labels.GetValue(key), value, c.caseSensitive) {
+			matches = append(matches, cnt)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return Container{}, NotFoundError{fmt.Sprintf("(container) could not find container by label: %s=%s", key, value)}
+	case 1:
+		return matches[0], nil
+	default:
+		return Container{}, fmt.Errorf("(container) label %s=%s matches %d containers", key, value, len(matches))
+	}
+}
+
+// GetContainerByIP returns the container with the given primary IP address.
+func (c *TemplateContext) GetContainerByIP(ip string) (Container, error) {
+	addr := normalizeIP(ip)
+	if addr == "" {
+		return Container{}, NotFoundError{"(container) could not find container by IP: " + ip}
+	}
+	for _, cnt := range c.Containers {
+		if cnt.Address != "" && addr == normalizeIP(cnt.Address) {
+			return cnt, nil
+		}
+	}
+
+	return Container{}, NotFoundError{"(container) could not find container by IP: " + ip}
+}
+
+// GetContainersByService returns the containers of the service matching the
+// given identifier in the form 'service-name[.stack-name]'.
+// If the argument is omitted the containers of the current service are returned.
+func (c *TemplateContext) GetContainersByService(v ...string) ([]Container, error) {
+	s, err := c.GetService(v...)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.Containers, nil
+}
+
+// GetContainersByStack returns the containers of all services in the given
+// stack. If the argument is omitted the containers of the current stack are
+// returned.
+func (c *TemplateContext) GetContainersByStack(v ...string) ([]Container, error) {
+	stack := ""
+	if len(v) > 0 {
+		stack = v[0]
+	}
+	if stack == "" {
+		stack = c.Self.Stack
+	}
+
+	result := make([]Container, 0)
+	for _, cnt := range c.Containers {
+		if c.equal(stack, cnt.Stack) {
+			result = append(result, cnt)
+		}
+	}
+
+	return result, nil
+}
+
+// GetContainersByImage returns the containers whose image matches the given
+// glob pattern, e.g. 'redis:*', or regex pattern matching the whole image.
+// Unless case-sensitive is set both kinds of patterns ignore case.
+func (c *TemplateContext) GetContainersByImage(pattern string) ([]Container, error) {
+	_, globErr := path.Match(pattern, "")
+	flags := "(?i)"
+	if c.caseSensitive {
+		flags = ""
+	}
+	rx, rxErr := regexp.Compile(flags + "^(?:" + pattern + ")$")
+	if globErr != nil && rxErr != nil {
+		return nil, fmt.Errorf("(containers) invalid image pattern '%s'", pattern)
+	}
+
+	result := make([]Container, 0)
+	for _, cnt := range c.Containers {
+		if (globErr == nil && globMatches(cnt.Image, pattern, c.caseSensitive)) ||
+			(rxErr == nil && rx.MatchString(cnt.Image)) {
+			result = append(result, cnt)
+		}
+	}
+
+	return result, nil
+}
+
+// GetPrimaryContainer returns the primary container of the service matching
+// the given identifier in the form 'service-name[.stack-name]'. That is the
+// container whose primary label is set to 'true' or else the one with the
+// lowest instance number. If the argument is omitted the primary container
+// of the current service is returned.
+func (c *TemplateContext) GetPrimaryContainer(v ...string) (Container, error) {
+	s, err := c.GetService(v...)
+	if err != nil {
+		return Container{}, err
+	}
+	if len(s.Containers) == 0 {
+		return Container{}, NotFoundError{"(container) service has no containers: " + s.Name}
+	}
+
+	if c.primaryLabel != "" {
+		for _, cnt := range s.Containers {
+			if strings.EqualFold(cnt.Labels.GetValue(c.primaryLabel), "true") {
+				return cnt, nil
+			}
+		}
+	}
+
+	primary := s.Containers[0]
+	for _, cnt := range s.Containers[1:] {
+		if instanceNumber(cnt.Name) < instanceNumber(primary.Name) {
+			primary = cnt
+		}
+	}
+
+	return primary, nil
 }
 
+// GetServiceLinks returns the services linked by the service matching the
+// given identifier in the form 'service-name[.stack-name]'. Links to missing
+// services are skipped. If the argument is omitted the linked services of
+// the current service are returned.
+func (c *TemplateContext) GetServiceLinks(v ...string) ([]Service, error) {
+	s, err := c.GetService(v...)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]Service, 0, len(s.Links))
+	for _, link := range s.Links {
+		linked, err := c.GetService(link)
+		if err != nil {
+			log.Warnf("Skipping link of service %s: %v", s.Name, err)
+			continue
+		}
+		result = append(result, linked)
+	}
+
+	return result, nil
+}
+
+// GetSidekicks returns the sidekick services of the service matching the
+// given identifier in the form 'service-name[.stack-name]'.
+// If the argument is omitted the sidekicks of the current service are returned.
+func (c *TemplateContext) GetSidekicks(v ...string) ([]Service, error) {
+	s, err := c.GetService(v...)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]Service, 0, len(s.Sidekicks))
+	for _, name := range s.Sidekicks {
+		for _, sk := range c.Services {
+			if c.equal(sk.Name, name) && c.equal(sk.Stack, s.Stack) {
+				result = append(result, sk)
+				break
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// GetServicesInStack returns the services of the given stack. If the
+// argument is omitted the services of the current stack are returned.
+func (c *TemplateContext) GetServicesInStack(v ...string) ([]Service, error) {
+	stack := ""
+	if len(v) > 0 {
+		stack = v[0]
+	}
+	if stack == "" {
+		stack = c.Self.Stack
+	}
+
+	return c.filterServicesByStack(c.Services, stack), nil
+}
+
+// GetStacks returns all stacks with their services, sorted by name.
+func (c *TemplateContext) GetStacks() ([]Stack, error) {
+	stacks := make([]Stack, 0)
+	index := make(map[string]int)
+	for _, s := range c.Services {
+		key := s.Stack
+		if !c.caseSensitive {
+			key = strings.ToLower(key)
+		}
+		i, ok := index[key]
+		if !ok {
+			i = len(stacks)
+			index[key] = i
+			stacks = append(stacks, Stack{Name: s.Stack})
+		}
+		stacks[i].Services = append(stacks[i].Services, s)
+	}
+
+	sort.SliceStable(stacks, func(i, j int) bool {
+		return nameUUIDLess(stacks[i].Name, "", stacks[j].Name, "")
+	})
+
+	return stacks, nil
+}
+
+// GetStack returns the stack with the given name and its services. If the
+// argument is omitted the stack of the current container is returned.
+func (c *TemplateContext) GetStack(v ...string) (Stack, error) {
+	name := ""
+	if len(v) > 0 {
+		name = v[0]
+	}
+	if name == "" {
+		name = c.Self.Stack
+	}
+
+	stacks, err := c.GetStacks()
+	if err != nil {
+		return Stack{}, err
+	}
+	for _, s := range stacks {
+		if c.equal(name, s.Name) {
+			return s, nil
+		}
+	}
+
+	return Stack{}, NotFoundError{"(stack) could not find stack by name: " + name}
+}
+
+// GetServiceScale returns the desired number of containers of the service
+// matching the given identifier in the form 'service-name[.stack-name]'.
+// If the argument is omitted the scale of the current service is returned.
+func (c *TemplateContext) GetServiceScale(v ...string) (int, error) {
+	s, err := c.GetService(v...)
+	if err != nil {
+		return 0, err
+	}
+
+	return s.Scale, nil
+}
+
+// GetServiceVip returns the virtual IP of the service matching the given
+// identifier in the form 'service-name[.stack-name]' or an empty string if it
+// has none. If the argument is omitted the VIP of the current service is
+// returned.
+func (c *TemplateContext) GetServiceVip(v ...string) (string, error) {
+	s, err := c.GetService(v...)
+	if err != nil {
+		return "", err
+	}
+
+	return s.Vip, nil
+}
+
+// GetServicePorts returns the public endpoints of the service matching the given
+// identifier in the form 'service-name[.stack-name]'.
+// If the argument is omitted the endpoints of the current service are returned.
+func (c *TemplateContext) GetServicePorts(v ...string) ([]PublicEndpoint, error) {
+	s, err := c.GetService(v...)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.PublicEndpoints, nil
+}
+
+// GetHosts returns all hosts, optionally filtered by label selectors.
 func (c *TemplateContext) GetHosts(selectors ...string) ([]Host, error) {
 	if len(selectors) == 0 {
-		return c.Hosts, nil
+		return sortHosts(c.Hosts), nil
 	}
 
-	labels := LabelMap{}
+	labels := make([]labelSelector, 0)
 
 	for _, f := range selectors {
+		f = strings.TrimSpace(f)
+		if len(f) == 0 {
+			return nil, fmt.Errorf("(hosts) empty selector")
+		}
 		if !strings.HasPrefix(f, "@") {
 			return nil, fmt.Errorf("(hosts) invalid argument '%s'", f)
 		}
-		f = f[1:len(f)]
-		parts := strings.Split(f, "=")
-		if len(parts) != 2 {
-			return nil, fmt.Errorf("(hosts) malformed label selector '%s'", f)
+		if err := parseLabelSelector(f, c.caseSensitive, &labels); err != nil {
+			return nil, fmt.Errorf("(hosts) %v", err)
+		}
+	}
+
+	return sortHosts(filterHostsByLabel(c.Hosts, labels)), nil
+}
+
+// GetHostsForService returns the hosts running the containers of the service
+// matching the given identifier in the form 'service-name[.stack-name]',
+// sorted by name. If the argument is omitted the hosts of the current service
+// are returned.
+func (c *TemplateContext) GetHostsForService(v ...string) ([]Host, error) {
+	s, err := c.GetService(v...)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]Host, 0)
+	seen := make(map[string]bool)
+	for _, cnt := range s.Containers {
+		key := strings.ToLower(cnt.HostUUID)
+		if key == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		// containers may refer to hosts missing from the metadata
+		if h, err := c.GetHost(cnt.HostUUID); err == nil {
+			result = append(result, h)
+		}
+	}
+
+	return sortHosts(result), nil
+}
+
+// GetHostsByAgentState returns the hosts whose agent is in the given state,
+// e.g. 'active' or 'reconnecting', optionally filtered by label selectors.
+func (c *TemplateContext) GetHostsByAgentState(state string, selectors ...string) ([]Host, error) {
+	hosts, err := c.GetHosts(selectors...)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]Host, 0)
+	for _, h := range hosts {
+		if strings.EqualFold(h.AgentState, state) {
+			result = append(result, h)
 		}
-		labels[parts[0]] = parts[1]
 	}
 
-	return filterHostsByLabel(c.Hosts, labels), nil
+	return result, nil
 }
 
+// GetContainers returns all containers, optionally filtered by label selectors.
+func (c *TemplateContext) GetContainers(selectors ...string) ([]Container, error) {
+	containers, err := c.selectContainers(selectors)
+	if err != nil {
+		return nil, err
+	}
+	return sortContainers(containers), nil
+}
+
+// GetContainersCount returns the number of containers GetContainers returns
+// for the selectors.
+func (c *TemplateContext) GetContainersCount(selectors ...string) (int, error) {
+	containers, err := c.selectContainers(selectors)
+	return len(containers), err
+}
+
+// selectContainers returns the containers matching the label selectors in
+// the order of the Metadata.
+func (c *TemplateContext) selectContainers(selectors []string) ([]Container, error) {
+	if len(selectors) == 0 {
+		return c.Containers, nil
+	}
+
+	labels := make([]labelSelector, 0)
+
+	for _, f := range selectors {
+		f = strings.TrimSpace(f)
+		if len(f) == 0 {
+			return nil, fmt.Errorf("(containers) empty selector")
+		}
+		if !strings.HasPrefix(f, "@") {
+			return nil, fmt.Errorf("(containers) invalid argument '%s'", f)
+		}
+		if err := parseLabelSelector(f, c.caseSensitive, &labels); err != nil {
+			return nil, fmt.Errorf("(containers) %v", err)
+		}
+	}
+
+	return filterContainersByLabel(c.Containers, labels), nil
+}
+
+// GetHealthyContainers returns all healthy containers, optionally filtered by
+// label selectors. Containers without a health check are considered healthy.
+func (c *TemplateContext) GetHealthyContainers(selectors ...string) ([]Container, error) {
+	containers, err := c.GetContainers(selectors...)
+	if err != nil {
+		return nil, err
+	}
+
+	return filterHealthyContainers(containers), nil
+}
+
+// GetContainersByHealthAndLabel returns the containers in the given health
+// state, optionally filtered by label selectors. Containers without a health
+// check are considered to be in the 'healthy' state.
+func (c *TemplateContext) GetContainersByHealthAndLabel(state string, selectors ...string) ([]Container, error) {
+	containers, err := c.GetContainers(selectors...)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.EqualFold(state, "healthy") {
+		return filterHealthyContainers(containers), nil
+	}
+
+	result := make([]Container, 0)
+	for _, cnt := range containers {
+		if strings.EqualFold(cnt.Health, state) {
+			result = append(result, cnt)
+		}
+	}
+	return result, nil
+}
+
+// GetContainersOnHost returns the containers running on the host with the
+// given UUID. If the argument is omitted the containers on the local host
+// are returned.
+func (c *TemplateContext) GetContainersOnHost(v ...string) ([]Container, error) {
+	uuid := ""
+	if len(v) > 0 {
+		uuid = v[0]
+	}
+	if uuid == "" {
+		uuid = c.Self.HostUUID
+	}
+
+	result := make([]Container, 0)
+	for _, cnt := range c.Containers {
+		if c.equal(uuid, cnt.HostUUID) {
+			result = append(result, cnt)
+		}
+	}
+
+	return result, nil
+}
+
+// GetServices returns all services, optionally filtered by stack selectors
+// in the form '.stack-name' and label selectors. Services matching any of
+// the stack selectors and all of the label selectors are returned.
 func (c *TemplateContext) GetServices(selectors ...string) ([]Service, error) {
+	services, err := c.selectServices(selectors)
+	if err != nil {
+		return nil, err
+	}
+	return sortServices(services), nil
+}
+
+// GetServicesCount returns the number of services GetServices returns for
+// the selectors.
+func (c *TemplateContext) GetServicesCount(selectors ...string) (int, error) {
+	services, err := c.selectServices(selectors)
+	return len(services), err
+}
+
+// selectServices returns the services matching the stack and label
+// selectors in the order of the Metadata.
+func (c *TemplateContext) selectServices(selectors []string) ([]Service, error) {
 	if len(selectors) == 0 {
 		return c.Services, nil
 	}
 
-	labels := LabelMap{}
-	var stack string
+	labels := make([]labelSelector, 0)
+	stacks := make([]string, 0)
 
 	for _, f := range selectors {
+		f = strings.TrimSpace(f)
+		if len(f) == 0 {
+			return nil, fmt.Errorf("(services) empty selector")
+		}
 		switch f[:1] {
 		case ".":
-			if len(stack) > 0 {
-				return nil, fmt.Errorf("(services) invalid use of multiple stack selectors '%s'", f)
+			if len(f) == 1 {
+				return nil, fmt.Errorf("(services) empty stack selector '%s'", f)
 			}
-			stack = f[1:len(f)]
+			stacks = append(stacks, f[1:len(f)])
 		case "@":
-			parts := strings.Split(f[1:len(f)], "=")
-			if len(parts) != 2 {
-				return nil, fmt.Errorf("(services) malformed label selector '%s'", f)
+			if err := parseLabelSelector(f, c.caseSensitive, &labels); err != nil {
+				return nil, fmt.Errorf("(services) %v", err)
 			}
-			labels[parts[0]] = parts[1]
 		default:
 			return nil, fmt.Errorf("(services) invalid argument '%s'", f)
 		}
@@ -126,8 +726,8 @@ func (c *TemplateContext) GetServices(selectors ...string) ([]Service, error) {
 
 	services := c.Services
 
-	if len(stack) > 0 {
-		services = filterServicesByStack(services, stack)
+	if len(stacks) > 0 {
+		services = c.filterServicesByStack(services, stacks...)
 	}
 	if len(labels) > 0 {
 		services = filterServicesByLabel(services, labels)
@@ -136,52 +736,133 @@ func (c *TemplateContext) GetServices(selectors ...string) ([]Service, error) {
 	return services, nil
 }
 
-// returns true if the LabelMap needle is a subset of the LabelMap stack.
-// the needle map may contain regex in it's values.
-func inLabelMap(stack, needle LabelMap) bool {
-	match := true
-	for k, v := range needle {
-		if stack.Exists(k) {
-			if strings.EqualFold(stack.GetValue(k), v) {
-				continue
-			}
-			// regex match
-			rx, err := regexp.Compile(v)
-			if err == nil && rx.MatchString(stack.GetValue(k)) {
-				continue
-			}
+// sortServices, sortContainers and sortHosts return a copy of the slice
+// sorted with nameUUIDLess so that templates render the same output
+// regardless of the order of the Metadata.
+func sortServices(in []Service) []Service {
+	out := append([]Service{}, in...)
+	sort.SliceStable(out, func(i, j int) bool {
+		return nameUUIDLess(out[i].Name, out[i].UUID, out[j].Name, out[j].UUID)
+	})
+	return out
+}
+
+func sortContainers(in []Container) []Container {
+	out := append([]Container{}, in...)
+	sort.SliceStable(out, func(i, j int) bool {
+		return nameUUIDLess(out[i].Name, out[i].UUID, out[j].Name, out[j].UUID)
+	})
+	return out
+}
+
+func sortHosts(in []Host) []Host {
+	out := append([]Host{}, in...)
+	sort.SliceStable(out, func(i, j int) bool {
+		return nameUUIDLess(out[i].Name, out[i].UUID, out[j].Name, out[j].UUID)
+	})
+	return out
+}
+
+// nameUUIDLess is the order of all lists returned to templates: by name
+// ignoring case, names that differ only in case by the exact name and
+// then by UUID.
+func nameUUIDLess(name1, uuid1, name2, uuid2 string) bool {
+	if a, b := strings.ToLower(name1), strings.ToLower(name2); a != b {
+		return a < b
+	}
+	if name1 != name2 {
+		return name1 < name2
+	}
+	return uuid1 < uuid2
+}
+
+// returns the instance number at the end of a container name like
+// 'stack_service_2' or the largest int if there is none.
+func instanceNumber(name string) int {
+	i := strings.LastIndexAny(name, "_-")
+	n, err := strconv.Atoi(name[i+1:])
+	if err != nil {
+		return int(^uint(0) >> 1)
+	}
+	return n
+}
+
+// returns the canonical form of an IP address, ignoring surrounding whitespace
+// and leading zeros in IPv4 octets.
+func normalizeIP(s string) string {
+	s = strings.TrimSpace(s)
+	if ip := net.ParseIP(s); ip != nil {
+		return ip.String()
+	}
+
+	octets := strings.Split(s, ".")
+	if len(octets) != 4 {
+		return s
+	}
+	for i, o := range octets {
+		n, err := strconv.Atoi(o)
+		if err != nil || n < 0 || n > 255 {
+			return s
 		}
-		match = false
-		break
+		octets[i] = strconv.Itoa(n)
 	}
-	return match
+	return strings.Join(octets, ".")
 }
 
-func filterHostsByLabel(hosts []Host, labels LabelMap) []Host {
+func filterHostsByLabel(hosts []Host, labels []labelSelector) []Host {
 	result := make([]Host, 0)
 	for _, h := range hosts {
-		if ok := inLabelMap(h.Labels, labels); ok {
+		if ok := matchLabelSelectors(h.Labels, labels); ok {
 			result = append(result, h)
 		}
 	}
 	return result
 }
 
-func filterServicesByLabel(services []Service, labels LabelMap) []Service {
+func filterContainersByLabel(containers []Container, labels []labelSelector) []Container {
+	result := make([]Container, 0)
+	for _, c := range containers {
+		if ok := matchLabelSelectors(c.Labels, labels); ok {
+			result = append(result, c)
+		}
+	}
+	return result
+}
+
+func filterHealthyContainers(containers []Container) []Container {
+	result := make([]Container, 0)
+	for _, c := range containers {
+		if isHealthyState(c.Health) {
+			result = append(result, c)
+		}
+	}
+	return result
+}
+
+// returns true for the 'healthy' state and for containers without a health check.
+func isHealthyState(health string) bool {
+	return health == "" || strings.EqualFold(health, "healthy")
+}
+
+func filterServicesByLabel(services []Service, labels []labelSelector) []Service {
 	result := make([]Service, 0)
 	for _, s := range services {
-		if ok := inLabelMap(s.Labels, labels); ok {
+		if ok := matchLabelSelectors(s.Labels, labels); ok {
 			result = append(result, s)
 		}
 	}
 	return result
 }
 
-func filterServicesByStack(services []Service, stack string) []Service {
+// returns the services belonging to any of the given stacks.
+func (c *TemplateContext) filterServicesByStack(services []Service, stacks ...string) []Service {
 	result := make([]Service, 0)
 	for _, s := range services {
-		if strings.EqualFold(s.Stack, stack) {
-			result = append(result, s)
+		for _, stack := range stacks {
+			if c.equal(s.Stack, stack) {
+				result = append(result, s)
+				break
+			}
 		}
 	}
 	return result
@@ -0,0 +1,787 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// newTestContext returns a context with two stacks on three hosts. The
+// current container is web_web_1.
+func newTestContext() *TemplateContext {
+	hosts := []Host{
+		{UUID: "host-1", Name: "node1", Hostname: "node1.example.com", Address: "192.168.0.1", AgentState: "active", Labels: LabelMap{"zone": "a"}},
+		{UUID: "host-2", Name: "node2", Hostname: "node2.example.com", Address: "192.168.0.2", AgentState: "reconnecting", Labels: LabelMap{"zone": "b"}},
+		{UUID: "host-3", Name: "node3", Hostname: "node3.example.com", Address: "192.168.0.3", AgentState: "inactive", Labels: LabelMap{}},
+	}
+	containers := []Container{
+		{UUID: "c-1", Name: "web_web_1", Stack: "web", Service: "web", Address: "10.0.0.1", Health: "healthy", State: "running", HostUUID: "host-1", Image: "nginx:1",
+			Ports:  []PortBinding{{PrivatePort: "8080", PublicPort: "80", Protocol: "tcp", IP: "0.0.0.0"}, {PrivatePort: "9090", Protocol: "tcp"}},
+			Labels: LabelMap{"tier": "web"}},
+		{UUID: "c-2", Name: "web_web_2", Stack: "web", Service: "web", Address: "10.0.0.2", Health: "unhealthy", State: "running", HostUUID: "host-2", Image: "nginx:1",
+			Labels: LabelMap{"tier": "web"}},
+		{UUID: "c-3", Name: "web_db_1", Stack: "web", Service: "db", Address: "10.0.0.3", Health: "", State: "running", HostUUID: "host-1", Image: "redis:5",
+			Labels: LabelMap{"tier": "db"}},
+		{UUID: "c-4", Name: "api_api_1", Stack: "api", Service: "api", Address: "10.0.1.1", Health: "initializing", State: "starting", HostUUID: "host-2", Image: "api:latest",
+			Labels: LabelMap{"tier": "frontend", "leader": "true"}},
+	}
+	for i := range containers {
+		for _, h := range hosts {
+			if h.UUID == containers[i].HostUUID {
+				containers[i].Host = h
+			}
+		}
+	}
+
+	services := []Service{
+		{UUID: "svc-web", Name: "web", Stack: "web", Kind: "service", Vip: "10.43.0.1", Scale: 3,
+			Sidekicks: []string{"db"}, Links: []string{"db.web", "missing.web"},
+			PublicEndpoints: []PublicEndpoint{{IPAddress: "192.168.0.1", PublicPort: "80", Protocol: "tcp"}},
+			Labels:          LabelMap{"tier": "frontend"}, Containers: containers[0:2]},
+		{UUID: "svc-db", Name: "db", Stack: "web", Kind: "service", Scale: 1,
+			Labels: LabelMap{"tier": "db"}, Containers: containers[2:3]},
+		{UUID: "svc-api", Name: "api", Stack: "api", Kind: "service", Scale: 1,
+			Labels: LabelMap{"tier": "frontend"}, Containers: containers[3:4]},
+	}
+
+	return &TemplateContext{
+		Services:   services,
+		Containers: containers,
+		Hosts:      hosts,
+		Self: Self{
+			ContainerName: "web_web_1",
+			Stack:         "web",
+			Service:       "web",
+			HostUUID:      "host-1",
+			Labels:        LabelMap{"tier": "web"},
+		},
+		primaryLabel: "io.rancher.primary",
+	}
+}
+
+func containerNames(containers []Container) string {
+	names := make([]string, 0, len(containers))
+	for _, c := range containers {
+		names = append(names, c.Name)
+	}
+	return strings.Join(names, ",")
+}
+
+func serviceNames(services []Service) string {
+	names := make([]string, 0, len(services))
+	for _, s := range services {
+		names = append(names, s.Name+"."+s.Stack)
+	}
+	return strings.Join(names, ",")
+}
+
+func hostNames(hosts []Host) string {
+	names := make([]string, 0, len(hosts))
+	for _, h := range hosts {
+		names = append(names, h.Name)
+	}
+	return strings.Join(names, ",")
+}
+
+func isNotFound(err error) bool {
+	_, ok := err.(NotFoundError)
+	return ok
+}
+
+func TestGetHost(t *testing.T) {
+	ctx := newTestContext()
+
+	h, err := ctx.GetHost()
+	if err != nil || h.Name != "node1" {
+		t.Errorf("GetHost() = %q, %v; want node1", h.Name, err)
+	}
+	h, err = ctx.GetHost("HOST-2")
+	if err != nil || h.Name != "node2" {
+		t.Errorf("GetHost(HOST-2) = %q, %v; want node2", h.Name, err)
+	}
+	if _, err := ctx.GetHost("host-9"); !isNotFound(err) {
+		t.Errorf("GetHost(host-9): expected NotFoundError, got %v", err)
+	}
+}
+
+func TestGetHostByName(t *testing.T) {
+	ctx := newTestContext()
+
+	for _, name := range []string{"node2", "node2.example.com", "NODE2"} {
+		h, err := ctx.GetHostByName(name)
+		if err != nil || h.UUID != "host-2" {
+			t.Errorf("GetHostByName(%q) = %q, %v; want host-2", name, h.UUID, err)
+		}
+	}
+	// UUIDs are not names
+	if _, err := ctx.GetHostByName("host-1"); !isNotFound(err) {
+		t.Errorf("GetHostByName(host-1): expected NotFoundError, got %v", err)
+	}
+}
+
+func TestGetContainer(t *testing.T) {
+	ctx := newTestContext()
+
+	c, err := ctx.GetContainer()
+	if err != nil || c.Name != "web_web_1" {
+		t.Errorf("GetContainer() = %q, %v; want web_web_1", c.Name, err)
+	}
+	c, err = ctx.GetContainer("web_db_1")
+	if err != nil || c.Name != "web_db_1" {
+		t.Errorf("GetContainer(web_db_1) = %q, %v", c.Name, err)
+	}
+
+	_, err = ctx.GetContainer("missing")
+	if !isNotFound(err) {
+		t.Fatalf("GetContainer(missing): expected NotFoundError, got %v", err)
+	}
+	if want := "(container) could not find container by name: missing"; err.Error() != want {
+		t.Errorf("GetContainer(missing) error = %q, want %q", err.Error(), want)
+	}
+}
+
+func TestGetService(t *testing.T) {
+	ctx := newTestContext()
+
+	tests := []struct {
+		identifier string
+		want       string
+	}{
+		{"", "svc-web"},
+		{"db", "svc-db"},
+		{"db.web", "svc-db"},
+		{"API.Api", "svc-api"},
+	}
+	for _, tt := range tests {
+		s, err := ctx.GetService(tt.identifier)
+		if err != nil || s.UUID != tt.want {
+			t.Errorf("GetService(%q) = %q, %v; want %q", tt.identifier, s.UUID, err, tt.want)
+		}
+	}
+
+	if _, err := ctx.GetService("api"); !isNotFound(err) {
+		t.Errorf("GetService(api) in the local stack: expected NotFoundError, got %v", err)
+	}
+	if _, err := ctx.GetService("a.b.c"); err == nil || isNotFound(err) {
+		t.Errorf("GetService(a.b.c): expected an invalid identifier error, got %v", err)
+	}
+}
+
+func TestGetServiceAmbiguous(t *testing.T) {
+	ctx := &TemplateContext{Services: []Service{
+		{Name: "web", Stack: "prod"},
+		{Name: "Web", Stack: "Prod"},
+	}}
+
+	_, err := ctx.GetService("web.prod")
+	if err == nil || !strings.Contains(err.Error(), "ambiguous") {
+		t.Errorf("expected an ambiguity error, got %v", err)
+	}
+
+	ctx.caseSensitive = true
+	s, err := ctx.GetService("Web.Prod")
+	if err != nil || s.Name != "Web" {
+		t.Errorf("case-sensitive GetService(Web.Prod) = %q, %v", s.Name, err)
+	}
+}
+
+func TestTryGet(t *testing.T) {
+	ctx := newTestContext()
+
+	if s := ctx.TryGetService("db"); s == nil || s.Name != "db" {
+		t.Errorf("TryGetService(db) = %v", s)
+	}
+	if s := ctx.TryGetService("missing"); s != nil {
+		t.Errorf("TryGetService(missing) = %v, want nil", s)
+	}
+	if c := ctx.TryGetContainer("web_db_1"); c == nil {
+		t.Error("TryGetContainer(web_db_1) = nil")
+	}
+	if c := ctx.TryGetContainer("missing"); c != nil {
+		t.Errorf("TryGetContainer(missing) = %v, want nil", c)
+	}
+	if h := ctx.TryGetHost("host-3"); h == nil {
+		t.Error("TryGetHost(host-3) = nil")
+	}
+	if h := ctx.TryGetHost("missing"); h != nil {
+		t.Errorf("TryGetHost(missing) = %v, want nil", h)
+	}
+}
+
+func TestGetSelf(t *testing.T) {
+	ctx := newTestContext()
+
+	self, err := ctx.GetSelf()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if self.Container.Name != "web_web_1" || self.Host.Name != "node1" || self.Service.Name != "web" {
+		t.Errorf("GetSelf() = %q, %q, %q", self.Container.Name, self.Host.Name, self.Service.Name)
+	}
+
+	ctx.Hosts = ctx.Hosts[1:]
+	if _, err := ctx.GetSelf(); !isNotFound(err) {
+		t.Errorf("GetSelf() without the local host: expected NotFoundError, got %v", err)
+	}
+}
+
+func TestGetSelfShortcuts(t *testing.T) {
+	ctx := newTestContext()
+
+	if c, err := ctx.GetSelfContainer(); err != nil || c.Name != "web_web_1" {
+		t.Errorf("GetSelfContainer() = %q, %v", c.Name, err)
+	}
+	if h, err := ctx.GetSelfHost(); err != nil || h.UUID != "host-1" {
+		t.Errorf("GetSelfHost() = %q, %v", h.UUID, err)
+	}
+	if s, err := ctx.GetSelfService(); err != nil || s.UUID != "svc-web" {
+		t.Errorf("GetSelfService() = %q, %v", s.UUID, err)
+	}
+
+	empty := &TemplateContext{Self: ctx.Self}
+	if _, err := empty.GetSelfContainer(); !isNotFound(err) {
+		t.Errorf("GetSelfContainer() without data: expected NotFoundError, got %v", err)
+	}
+	if _, err := empty.GetSelfHost(); !isNotFound(err) {
+		t.Errorf("GetSelfHost() without data: expected NotFoundError, got %v", err)
+	}
+	if _, err := empty.GetSelfService(); !isNotFound(err) {
+		t.Errorf("GetSelfService() without data: expected NotFoundError, got %v", err)
+	}
+}
+
+func TestGetServiceByUUID(t *testing.T) {
+	ctx := newTestContext()
+
+	if s, err := ctx.GetServiceByUUID("SVC-DB"); err != nil || s.Name != "db" {
+		t.Errorf("GetServiceByUUID(SVC-DB) = %q, %v", s.Name, err)
+	}
+	if _, err := ctx.GetServiceByUUID("svc-missing"); !isNotFound(err) {
+		t.Errorf("GetServiceByUUID(svc-missing): expected NotFoundError, got %v", err)
+	}
+}
+
+func TestGetServiceByContainer(t *testing.T) {
+	ctx := newTestContext()
+
+	if s, err := ctx.GetServiceByContainer(); err != nil || s.UUID != "svc-web" {
+		t.Errorf("GetServiceByContainer() = %q, %v", s.UUID, err)
+	}
+	if s, err := ctx.GetServiceByContainer("api_api_1"); err != nil || s.UUID != "svc-api" {
+		t.Errorf("GetServiceByContainer(api_api_1) = %q, %v", s.UUID, err)
+	}
+	if _, err := ctx.GetServiceByContainer("missing"); !isNotFound(err) {
+		t.Errorf("GetServiceByContainer(missing): expected NotFoundError, got %v", err)
+	}
+}
+
+func TestGetContainerPorts(t *testing.T) {
+	ctx := newTestContext()
+
+	ports, err := ctx.GetContainerPorts()
+	if err != nil || len(ports) != 2 {
+		t.Fatalf("GetContainerPorts() = %v, %v", ports, err)
+	}
+	if ports[0].PublicPort != "80" || ports[1].PublicPort != "" || ports[1].PrivatePort != "9090" {
+		t.Errorf("GetContainerPorts() = %+v", ports)
+	}
+}
+
+func TestGetContainerByLabel(t *testing.T) {
+	ctx := newTestContext()
+
+	c, err := ctx.GetContainerByLabel("leader", "true")
+	if err != nil || c.Name != "api_api_1" {
+		t.Errorf("GetContainerByLabel(leader, true) = %q, %v", c.Name, err)
+	}
+	if _, err := ctx.GetContainerByLabel("leader", "false"); !isNotFound(err) {
+		t.Errorf("GetContainerByLabel with no match: expected NotFoundError, got %v", err)
+	}
+	if _, err := ctx.GetContainerByLabel("tier", "web"); err == nil || isNotFound(err) {
+		t.Errorf("GetContainerByLabel with two matches: expected an error, got %v", err)
+	}
+}
+
+func TestGetContainerByIP(t *testing.T) {
+	ctx := newTestContext()
+
+	for _, ip := range []string{"10.0.0.3", " 10.0.0.3 ", "10.0.0.03"} {
+		c, err := ctx.GetContainerByIP(ip)
+		if err != nil || c.Name != "web_db_1" {
+			t.Errorf("GetContainerByIP(%q) = %q, %v", ip, c.Name, err)
+		}
+	}
+	if _, err := ctx.GetContainerByIP("10.9.9.9"); !isNotFound(err) {
+		t.Errorf("GetContainerByIP(10.9.9.9): expected NotFoundError, got %v", err)
+	}
+
+	// containers without an address never match
+	ctx.Containers = append([]Container{{Name: "no_address_1"}}, ctx.Containers...)
+	for _, ip := range []string{"", "  "} {
+		if c, err := ctx.GetContainerByIP(ip); !isNotFound(err) {
+			t.Errorf("GetContainerByIP(%q) = %q, %v; want NotFoundError", ip, c.Name, err)
+		}
+	}
+}
+
+func TestGetContainersByService(t *testing.T) {
+	ctx := newTestContext()
+
+	cs, err := ctx.GetContainersByService()
+	if got := containerNames(cs); err != nil || got != "web_web_1,web_web_2" {
+		t.Errorf("GetContainersByService() = %q, %v", got, err)
+	}
+	cs, err = ctx.GetContainersByService("api.api")
+	if got := containerNames(cs); err != nil || got != "api_api_1" {
+		t.Errorf("GetContainersByService(api.api) = %q, %v", got, err)
+	}
+	if _, err := ctx.GetContainersByService("missing"); !isNotFound(err) {
+		t.Errorf("GetContainersByService(missing): expected NotFoundError, got %v", err)
+	}
+}
+
+func TestGetContainersByStack(t *testing.T) {
+	ctx := newTestContext()
+
+	cs, _ := ctx.GetContainersByStack()
+	if got := containerNames(cs); got != "web_web_1,web_web_2,web_db_1" {
+		t.Errorf("GetContainersByStack() = %q", got)
+	}
+	cs, _ = ctx.GetContainersByStack("API")
+	if got := containerNames(cs); got != "api_api_1" {
+		t.Errorf("GetContainersByStack(API) = %q", got)
+	}
+	cs, _ = ctx.GetContainersByStack("none")
+	if len(cs) != 0 {
+		t.Errorf("GetContainersByStack(none) = %q", containerNames(cs))
+	}
+}
+
+func TestGetContainersByImage(t *testing.T) {
+	ctx := newTestContext()
+
+	tests := []struct {
+		pattern       string
+		caseSensitive bool
+		want          string
+	}{
+		{"redis:*", false, "web_db_1"},
+		{"redis:[0-9]+", false, "web_db_1"},
+		{"nginx:1", false, "web_web_1,web_web_2"},
+		{"mysql:*", false, ""},
+		{"REDIS:*", false, "web_db_1"},
+		{"REDIS:[0-9]+", false, "web_db_1"},
+		{"REDIS:*", true, ""},
+		{"REDIS:[0-9]+", true, ""},
+		{"redis:[0-9]+", true, "web_db_1"},
+	}
+	for _, tt := range tests {
+		ctx.caseSensitive = tt.caseSensitive
+		cs, err := ctx.GetContainersByImage(tt.pattern)
+		if got := containerNames(cs); err != nil || got != tt.want {
+			t.Errorf("GetContainersByImage(%q) with caseSensitive=%v = %q, %v; want %q", tt.pattern, tt.caseSensitive, got, err, tt.want)
+		}
+		if cs == nil {
+			t.Errorf("GetContainersByImage(%q) returned nil instead of an empty slice", tt.pattern)
+		}
+	}
+}
+
+func TestGetPrimaryContainer(t *testing.T) {
+	ctx := newTestContext()
+
+	c, err := ctx.GetPrimaryContainer()
+	if err != nil || c.Name != "web_web_1" {
+		t.Errorf("GetPrimaryContainer() = %q, %v; want the lowest instance", c.Name, err)
+	}
+
+	ctx.Services[0].Containers[1].Labels = LabelMap{"io.rancher.primary": "true"}
+	c, err = ctx.GetPrimaryContainer("web")
+	if err != nil || c.Name != "web_web_2" {
+		t.Errorf("GetPrimaryContainer(web) = %q, %v; want the labeled container", c.Name, err)
+	}
+
+	ctx.Services[1].Containers = nil
+	if _, err := ctx.GetPrimaryContainer("db"); !isNotFound(err) {
+		t.Errorf("GetPrimaryContainer of a service without containers: expected NotFoundError, got %v", err)
+	}
+}
+
+func TestGetServiceLinks(t *testing.T) {
+	ctx := newTestContext()
+
+	links, err := ctx.GetServiceLinks()
+	if got := serviceNames(links); err != nil || got != "db.web" {
+		t.Errorf("GetServiceLinks() = %q, %v; want the resolved link only", got, err)
+	}
+	links, err = ctx.GetServiceLinks("api.api")
+	if err != nil || len(links) != 0 {
+		t.Errorf("GetServiceLinks(api.api) = %q, %v", serviceNames(links), err)
+	}
+}
+
+func TestGetSidekicks(t *testing.T) {
+	ctx := newTestContext()
+	ctx.Services[0].Sidekicks = []string{"db", "api"}
+	ctx.Services = append(ctx.Services, Service{Name: "api", Stack: "web"})
+
+	sks, err := ctx.GetSidekicks()
+	if got := serviceNames(sks); err != nil || got != "db.web,api.web" {
+		t.Errorf("GetSidekicks() = %q, %v", got, err)
+	}
+	sks, err = ctx.GetSidekicks("db")
+	if err != nil || len(sks) != 0 {
+		t.Errorf("GetSidekicks(db) = %q, %v", serviceNames(sks), err)
+	}
+}
+
+func TestGetServicesInStack(t *testing.T) {
+	ctx := newTestContext()
+
+	ss, _ := ctx.GetServicesInStack()
+	if got := serviceNames(ss); got != "web.web,db.web" {
+		t.Errorf("GetServicesInStack() = %q", got)
+	}
+	ss, _ = ctx.GetServicesInStack("api")
+	if got := serviceNames(ss); got != "api.api" {
+		t.Errorf("GetServicesInStack(api) = %q", got)
+	}
+	ss, _ = ctx.GetServicesInStack("none")
+	if len(ss) != 0 {
+		t.Errorf("GetServicesInStack(none) = %q", serviceNames(ss))
+	}
+}
+
+func TestGetStacks(t *testing.T) {
+	ctx := &TemplateContext{Services: []Service{
+		{Name: "web", Stack: "prod"},
+		{Name: "db", Stack: "Prod"},
+		{Name: "api", Stack: "dev"},
+	}}
+
+	stacks, err := ctx.GetStacks()
+	if err != nil || len(stacks) != 2 {
+		t.Fatalf("GetStacks() = %v, %v", stacks, err)
+	}
+	if stacks[0].Name != "dev" || serviceNames(stacks[1].Services) != "web.prod,db.Prod" {
+		t.Errorf("GetStacks() = %+v", stacks)
+	}
+
+	ctx.caseSensitive = true
+	stacks, _ = ctx.GetStacks()
+	if len(stacks) != 3 || stacks[1].Name != "Prod" || stacks[2].Name != "prod" {
+		t.Errorf("case-sensitive GetStacks() = %+v", stacks)
+	}
+}
+
+func TestGetStack(t *testing.T) {
+	ctx := newTestContext()
+
+	s, err := ctx.GetStack()
+	if err != nil || s.Name != "web" || len(s.Services) != 2 {
+		t.Errorf("GetStack() = %+v, %v", s, err)
+	}
+	s, err = ctx.GetStack("API")
+	if err != nil || serviceNames(s.Services) != "api.api" {
+		t.Errorf("GetStack(API) = %+v, %v", s, err)
+	}
+	if _, err := ctx.GetStack("none"); !isNotFound(err) {
+		t.Errorf("GetStack(none): expected NotFoundError, got %v", err)
+	}
+}
+
+func TestGetServiceScale(t *testing.T) {
+	ctx := newTestContext()
+
+	scale, err := ctx.GetServiceScale()
+	if err != nil || scale != 3 {
+		t.Errorf("GetServiceScale() = %d, %v", scale, err)
+	}
+	s, _ := ctx.GetService()
+	if len(s.Containers) >= scale {
+		t.Errorf("fixture should have fewer containers (%d) than its scale (%d)", len(s.Containers), scale)
+	}
+}
+
+func TestGetServiceVip(t *testing.T) {
+	ctx := newTestContext()
+
+	if vip, err := ctx.GetServiceVip("web"); err != nil || vip != "10.43.0.1" {
+		t.Errorf("GetServiceVip(web) = %q, %v", vip, err)
+	}
+	if vip, err := ctx.GetServiceVip("db"); err != nil || vip != "" {
+		t.Errorf("GetServiceVip(db) = %q, %v; want no VIP and no error", vip, err)
+	}
+	if _, err := ctx.GetServiceVip("missing"); !isNotFound(err) {
+		t.Errorf("GetServiceVip(missing): expected NotFoundError, got %v", err)
+	}
+}
+
+func TestGetServicePorts(t *testing.T) {
+	ctx := newTestContext()
+
+	eps, err := ctx.GetServicePorts()
+	if err != nil || len(eps) != 1 || eps[0].PublicPort != "80" {
+		t.Errorf("GetServicePorts() = %+v, %v", eps, err)
+	}
+	eps, err = ctx.GetServicePorts("db")
+	if err != nil || len(eps) != 0 {
+		t.Errorf("GetServicePorts(db) = %+v, %v", eps, err)
+	}
+}
+
+func TestGetHostsForService(t *testing.T) {
+	ctx := newTestContext()
+
+	hosts, err := ctx.GetHostsForService()
+	if got := hostNames(hosts); err != nil || got != "node1,node2" {
+		t.Errorf("GetHostsForService() = %q, %v", got, err)
+	}
+
+	ctx.Services[1].Containers = append(ctx.Services[1].Containers, Container{Name: "web_db_2", HostUUID: "host-gone"})
+	hosts, err = ctx.GetHostsForService("db")
+	if got := hostNames(hosts); err != nil || got != "node1" {
+		t.Errorf("GetHostsForService(db) with a dangling host = %q, %v", got, err)
+	}
+
+	// hosts with the same name are ordered by UUID
+	ctx = &TemplateContext{
+		Hosts: []Host{{UUID: "host-b", Name: "node"}, {UUID: "host-a", Name: "node"}},
+		Services: []Service{{Name: "web", Stack: "web", Containers: []Container{
+			{Name: "web_web_1", HostUUID: "host-b"},
+			{Name: "web_web_2", HostUUID: "host-a"},
+		}}},
+	}
+	hosts, err = ctx.GetHostsForService("web.web")
+	if err != nil || len(hosts) != 2 || hosts[0].UUID != "host-a" || hosts[1].UUID != "host-b" {
+		t.Errorf("GetHostsForService(web.web) = %+v, %v", hosts, err)
+	}
+}
+
+func TestGetHostsByAgentState(t *testing.T) {
+	ctx := newTestContext()
+
+	for _, tt := range []struct{ state, want string }{
+		{"active", "node1"},
+		{"reconnecting", "node2"},
+		{"INACTIVE", "node3"},
+		{"unknown", ""},
+	} {
+		hosts, err := ctx.GetHostsByAgentState(tt.state)
+		if got := hostNames(hosts); err != nil || got != tt.want {
+			t.Errorf("GetHostsByAgentState(%q) = %q, %v; want %q", tt.state, got, err, tt.want)
+		}
+	}
+
+	hosts, _ := ctx.GetHostsByAgentState("reconnecting", "@zone=a")
+	if len(hosts) != 0 {
+		t.Errorf("GetHostsByAgentState(reconnecting, @zone=a) = %q", hostNames(hosts))
+	}
+}
+
+func TestGetHealthyContainers(t *testing.T) {
+	ctx := newTestContext()
+
+	cs, err := ctx.GetHealthyContainers()
+	if got := containerNames(cs); err != nil || got != "web_db_1,web_web_1" {
+		t.Errorf("GetHealthyContainers() = %q, %v", got, err)
+	}
+	cs, _ = ctx.GetHealthyContainers("@tier=web")
+	if got := containerNames(cs); got != "web_web_1" {
+		t.Errorf("GetHealthyContainers(@tier=web) = %q", got)
+	}
+}
+
+func TestGetContainersByHealthAndLabel(t *testing.T) {
+	ctx := newTestContext()
+
+	tests := []struct {
+		state     string
+		selectors []string
+		want      string
+	}{
+		{"healthy", []string{"@tier=web"}, "web_web_1"},
+		{"unhealthy", []string{"@tier=web"}, "web_web_2"},
+		{"healthy", nil, "web_db_1,web_web_1"},
+		{"initializing", nil, "api_api_1"},
+		{"healthy", []string{"@tier=frontend"}, ""},
+	}
+	for _, tt := range tests {
+		cs, err := ctx.GetContainersByHealthAndLabel(tt.state, tt.selectors...)
+		if got := containerNames(cs); err != nil || got != tt.want {
+			t.Errorf("GetContainersByHealthAndLabel(%q, %v) = %q, %v; want %q", tt.state, tt.selectors, got, err, tt.want)
+		}
+	}
+}
+
+func TestGetContainersOnHost(t *testing.T) {
+	ctx := newTestContext()
+
+	cs, _ := ctx.GetContainersOnHost()
+	if got := containerNames(cs); got != "web_web_1,web_db_1" {
+		t.Errorf("GetContainersOnHost() = %q", got)
+	}
+	cs, _ = ctx.GetContainersOnHost("host-2")
+	if got := containerNames(cs); got != "web_web_2,api_api_1" {
+		t.Errorf("GetContainersOnHost(host-2) = %q", got)
+	}
+}
+
+func TestGetServicesSelectors(t *testing.T) {
+	ctx := newTestContext()
+	ctx.Services = append(ctx.Services,
+		Service{Name: "ui", Stack: "front", Labels: LabelMap{"tier": "frontend"}},
+		Service{Name: "batch", Stack: "api", Labels: LabelMap{"tier": "backend"}},
+	)
+
+	tests := []struct {
+		selectors []string
+		want      string
+	}{
+		{[]string{" .web ", " @tier=db"}, "db.web"},
+		{nil, "api.api,batch.api,db.web,ui.front,web.web"},
+		{[]string{".web"}, "db.web,web.web"},
+		{[]string{".web", ".api", "@tier=frontend"}, "api.api,web.web"},
+		{[]string{"@tier!=frontend"}, "batch.api,db.web"},
+	}
+	for _, tt := range tests {
+		ss, err := ctx.GetServices(tt.selectors...)
+		if got := serviceNames(ss); err != nil || got != tt.want {
+			t.Errorf("GetServices(%q) = %q, %v; want %q", tt.selectors, got, err, tt.want)
+		}
+	}
+}
+
+func TestInvalidSelectors(t *testing.T) {
+	ctx := newTestContext()
+
+	for _, sel := range []string{"", "@", ".", " ", "web"} {
+		if _, err := ctx.GetServices(sel); err == nil {
+			t.Errorf("GetServices(%q): expected an error", sel)
+		}
+		if _, err := ctx.GetContainers(sel); err == nil {
+			t.Errorf("GetContainers(%q): expected an error", sel)
+		}
+		if _, err := ctx.GetHosts(sel); err == nil {
+			t.Errorf("GetHosts(%q): expected an error", sel)
+		}
+	}
+}
+
+func TestCaseSensitiveLookups(t *testing.T) {
+	ctx := newTestContext()
+
+	if _, err := ctx.GetService("WEB"); err != nil {
+		t.Errorf("case-insensitive GetService(WEB): %v", err)
+	}
+	cs, _ := ctx.GetContainers("@tier=WEB")
+	if len(cs) != 2 {
+		t.Errorf("case-insensitive GetContainers(@tier=WEB) = %q", containerNames(cs))
+	}
+
+	ctx.caseSensitive = true
+	if _, err := ctx.GetService("WEB"); !isNotFound(err) {
+		t.Errorf("case-sensitive GetService(WEB): expected NotFoundError, got %v", err)
+	}
+	cs, _ = ctx.GetContainers("@tier=WEB")
+	if len(cs) != 0 {
+		t.Errorf("case-sensitive GetContainers(@tier=WEB) = %q", containerNames(cs))
+	}
+}
+
+func TestSortedResults(t *testing.T) {
+	ctx := newTestContext()
+	shuffled := &TemplateContext{
+		Services:   []Service{ctx.Services[2], ctx.Services[0], ctx.Services[1]},
+		Containers: []Container{ctx.Containers[3], ctx.Containers[1], ctx.Containers[2], ctx.Containers[0]},
+		Hosts:      []Host{ctx.Hosts[2], ctx.Hosts[0], ctx.Hosts[1]},
+	}
+
+	for _, c := range []*TemplateContext{ctx, shuffled} {
+		ss, _ := c.GetServices()
+		if got := serviceNames(ss); got != "api.api,db.web,web.web" {
+			t.Errorf("GetServices() = %q", got)
+		}
+		cs, _ := c.GetContainers("@tier")
+		if got := containerNames(cs); got != "api_api_1,web_db_1,web_web_1,web_web_2" {
+			t.Errorf("GetContainers(@tier) = %q", got)
+		}
+		hs, _ := c.GetHosts()
+		if got := hostNames(hs); got != "node1,node2,node3" {
+			t.Errorf("GetHosts() = %q", got)
+		}
+	}
+
+	// the context itself keeps the order of the Metadata
+	if shuffled.Services[0].Name != "api" || shuffled.Hosts[0].Name != "node3" {
+		t.Error("sorting modified the context")
+	}
+
+	dup := &TemplateContext{Services: []Service{{Name: "web", UUID: "b"}, {Name: "web", UUID: "a"}}}
+	ss, _ := dup.GetServices()
+	if ss[0].UUID != "a" {
+		t.Errorf("services with the same name are not sorted by UUID: %+v", ss)
+	}
+
+	// all lists share the order of GetStacks: case is ignored first
+	mixed := &TemplateContext{
+		Containers: []Container{{Name: "web_2", UUID: "c"}, {Name: "Web_1", UUID: "b"}, {Name: "api_1", UUID: "a"}},
+		Hosts:      []Host{{Name: "node", UUID: "b"}, {Name: "Node", UUID: "c"}, {Name: "node", UUID: "a"}},
+	}
+	cs, _ := mixed.GetContainers()
+	if got := containerNames(cs); got != "api_1,Web_1,web_2" {
+		t.Errorf("GetContainers() = %q", got)
+	}
+	hs, _ := mixed.GetHosts()
+	if hs[0].UUID != "c" || hs[1].UUID != "a" || hs[2].UUID != "b" {
+		t.Errorf("GetHosts() = %+v", hs)
+	}
+}
+
+func TestCounts(t *testing.T) {
+	ctx := newTestContext()
+
+	for _, sel := range [][]string{nil, {"@tier=web"}, {".web"}, {".api", "@tier=frontend"}} {
+		ss, _ := ctx.GetServices(sel...)
+		n, err := ctx.GetServicesCount(sel...)
+		if err != nil || n != len(ss) {
+			t.Errorf("GetServicesCount(%q) = %d, %v; want %d", sel, n, err, len(ss))
+		}
+	}
+	for _, sel := range [][]string{nil, {"@tier=web"}, {"@tier!=web"}, {"@none"}} {
+		cs, _ := ctx.GetContainers(sel...)
+		n, err := ctx.GetContainersCount(sel...)
+		if err != nil || n != len(cs) {
+			t.Errorf("GetContainersCount(%q) = %d, %v; want %d", sel, n, err, len(cs))
+		}
+	}
+	if _, err := ctx.GetContainersCount("bad"); err == nil {
+		t.Error("GetContainersCount(bad): expected an error")
+	}
+}
+
+func TestNormalizeIP(t *testing.T) {
+	tests := map[string]string{
+		"10.0.0.1":      "10.0.0.1",
+		" 10.0.0.1\t":   "10.0.0.1",
+		"010.000.000.1": "10.0.0.1",
+		"::0001":        "::1",
+		"not-an-ip":     "not-an-ip",
+	}
+	for in, want := range tests {
+		if got := normalizeIP(in); got != want {
+			t.Errorf("normalizeIP(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestInstanceNumber(t *testing.T) {
+	if n := instanceNumber("stack_service_12"); n != 12 {
+		t.Errorf("instanceNumber(stack_service_12) = %d", n)
+	}
+	if n := instanceNumber("stack-service-3"); n != 3 {
+		t.Errorf("instanceNumber(stack-service-3) = %d", n)
+	}
+	if a, b := instanceNumber("service"), instanceNumber("service_1"); a <= b {
+		t.Errorf("a name without instance number should sort last: %d <= %d", a, b)
+	}
+}
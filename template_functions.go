@@ -1,10 +1,19 @@
 package main
 
 import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"hash/fnv"
+	"math"
+	"net"
 	"os"
 	"path"
+	"reflect"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"text/template"
 	"time"
@@ -15,26 +24,68 @@ import (
 func newFuncMap(ctx *TemplateContext) template.FuncMap {
 	return template.FuncMap{
 		// Utility funcs
-		"base":      path.Base,
-		"dir":       path.Dir,
-		"env":       os.Getenv,
-		"timestamp": time.Now,
-		"split":     strings.Split,
-		"join":      strings.Join,
-		"toUpper":   strings.ToUpper,
-		"toLower":   strings.ToLower,
-		"contains":  strings.Contains,
-		"replace":   strings.Replace,
+		"base":         path.Base,
+		"dir":          path.Dir,
+		"env":          env,
+		"timestamp":    time.Now,
+		"split":        split,
+		"join":         join,
+		"toUpper":      toUpper,
+		"toLower":      toLower,
+		"title":        title,
+		"contains":     contains,
+		"hasPrefix":    hasPrefix,
+		"hasSuffix":    hasSuffix,
+		"trim":         trim,
+		"trimSpace":    strings.TrimSpace,
+		"trimPrefix":   trimPrefix,
+		"trimSuffix":   trimSuffix,
+		"replace":      replace,
+		"replaceN":     replaceN,
+		"json":         toJSON,
+		"jsonPretty":   toPrettyJSON,
+		"parseJSON":    parseJSON,
+		"base64Encode": base64Encode,
+		"base64Decode": base64Decode,
+		"default":      defaultValue,
+		"seq":          seq,
+		"seqStep":      seqStep,
+		"add":          add,
+		"sub":          sub,
+		"mul":          mul,
+		"div":          div,
+		"atoi":         atoi,
+		"itoa":         strconv.Itoa,
+		"hash":         hash,
+		"hashMod":      hashMod,
 
 		// Service funcs
 		"host":              hostFunc(ctx),
 		"hosts":             hostsFunc(ctx),
+		"container":         containerFunc(ctx),
+		"containers":        containersFunc(ctx),
 		"service":           serviceFunc(ctx),
 		"services":          servicesFunc(ctx),
+		"resolveService":    resolveServiceFunc(ctx),
 		"whereLabelExists":  whereLabelExists,
-		"whereLabelEquals":  whereLabelEquals,
-		"whereLabelMatches": whereLabelEquals,
+		"whereLabelEquals":  whereLabelEqualsFunc(ctx),
+		"whereLabelMatches": whereLabelMatches,
+		"whereLabel":        whereLabelFunc(ctx),
+		"whereField":        whereField,
 		"groupByLabel":      groupByLabel,
+		"sortedKeys":        sortedKeys,
+		"hasLabel":          hasLabel,
+		"label":             label,
+		"labels":            labels,
+		"labelKeys":         labelKeys,
+		"labelValues":       labelValues,
+		"isHealthy":         isHealthy,
+		"whereState":        whereState,
+		"sortByName":        sortByName,
+		"sortByUUID":        sortByUUID,
+		"first":             first,
+		"last":              last,
+		"count":             count,
 	}
 }
 
@@ -59,6 +110,35 @@ func servicesFunc(ctx *TemplateContext) func(...string) (interface{}, error) {
 	}
 }
 
+// resolveServiceFunc returns the sorted IP addresses of the healthy containers
+// of a service given a string argument in the form <service-name>[.<stack-name>].
+func resolveServiceFunc(ctx *TemplateContext) func(...string) ([]string, error) {
+	return func(s ...string) ([]string, error) {
+		service, err := ctx.GetService(s...)
+		if _, ok := err.(NotFoundError); ok {
+			log.Debug(err)
+			return []string{}, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		ips := make([]string, 0, len(service.Containers))
+		for _, c := range service.Containers {
+			if isHealthyState(c.Health) && c.Address != "" {
+				ips = append(ips, c.Address)
+			}
+		}
+		sort.Slice(ips, func(i, j int) bool {
+			a, b := net.ParseIP(ips[i]), net.ParseIP(ips[j])
+			if a == nil || b == nil {
+				return ips[i] < ips[j]
+			}
+			return bytes.Compare(a.To16(), b.To16()) < 0
+		})
+		return ips, nil
+	}
+}
+
 // hostFunc returns a single host given it's UUID.
 func hostFunc(ctx *TemplateContext) func(...string) (interface{}, error) {
 	return func(s ...string) (result interface{}, err error) {
@@ -78,15 +158,36 @@ func hostsFunc(ctx *TemplateContext) func(...string) (interface{}, error) {
 	}
 }
 
-// groupByLabel takes a label key and a slice of services or hosts and returns a map based
-// on the values of the label.
+// containerFunc returns a single container given it's name.
+func containerFunc(ctx *TemplateContext) func(...string) (interface{}, error) {
+	return func(s ...string) (result interface{}, err error) {
+		result, err = ctx.GetContainer(s...)
+		if _, ok := err.(NotFoundError); ok {
+			log.Debug(err)
+			return nil, nil
+		}
+		return
+	}
+}
+
+// containersFunc returns all available containers, optionally filtered by label value.
+func containersFunc(ctx *TemplateContext) func(...string) (interface{}, error) {
+	return func(s ...string) (interface{}, error) {
+		return ctx.GetContainers(s...)
+	}
+}
+
+// groupByLabel takes a label key and a slice of services, containers or hosts
+// and returns a map based on the values of the label.
 //
 // The map key is a string representing the label value. The map value is a
-// slice of services or hosts that have the corresponding label value.
+// slice of the input type holding the entries with the corresponding label
+// value. Entries without the label are grouped under the empty string key.
 // Example:
-//    {{range $labelValue, $containers := svc.Containers | groupByLabel "foo"}}
-func groupByLabel(label string, in interface{}) (map[string][]interface{}, error) {
-	m := make(map[string][]interface{})
+//
+//	{{range $labelValue, $containers := svc.Containers | groupByLabel "foo"}}
+func groupByLabel(label string, in interface{}) (map[string]interface{}, error) {
+	m := make(map[string]interface{})
 
 	if in == nil {
 		return m, fmt.Errorf("(groupByLabel) input is nil")
@@ -94,25 +195,31 @@ func groupByLabel(label string, in interface{}) (map[string][]interface{}, error
 
 	switch typed := in.(type) {
 	case []Service:
+		groups := make(map[string][]Service)
 		for _, s := range typed {
-			value, ok := s.Labels[label]
-			if ok && len(value) > 0 {
-				m[value] = append(m[value], s)
-			}
+			value := s.Labels[label]
+			groups[value] = append(groups[value], s)
+		}
+		for k, v := range groups {
+			m[k] = v
 		}
 	case []Container:
+		groups := make(map[string][]Container)
 		for _, c := range typed {
-			value, ok := c.Labels[label]
-			if ok && len(value) > 0 {
-				m[value] = append(m[value], c)
-			}
+			value := c.Labels[label]
+			groups[value] = append(groups[value], c)
+		}
+		for k, v := range groups {
+			m[k] = v
 		}
 	case []Host:
+		groups := make(map[string][]Host)
 		for _, h := range typed {
-			value, ok := h.Labels[label]
-			if ok && len(value) > 0 {
-				m[value] = append(m[value], h)
-			}
+			value := h.Labels[label]
+			groups[value] = append(groups[value], h)
+		}
+		for k, v := range groups {
+			m[k] = v
 		}
 	default:
 		return m, fmt.Errorf("(groupByLabel) invalid input type %T", in)
@@ -121,66 +228,678 @@ func groupByLabel(label string, in interface{}) (map[string][]interface{}, error
 	return m, nil
 }
 
-func whereLabel(funcName string, in interface{}, label string, test func(string, bool) bool) ([]interface{}, error) {
-	result := make([]interface{}, 0)
+// sortedKeys returns the keys of a map with string keys in sorted order.
+// Example:
+//
+//	{{$groups := groupByLabel "foo" services}}
+//	{{range $key := sortedKeys $groups}}{{index $groups $key}}{{end}}
+func sortedKeys(in interface{}) ([]string, error) {
+	v := reflect.ValueOf(in)
+	if v.Kind() != reflect.Map || v.Type().Key().Kind() != reflect.String {
+		return nil, fmt.Errorf("(sortedKeys) invalid input type %T", in)
+	}
+
+	keys := make([]string, 0, v.Len())
+	for _, k := range v.MapKeys() {
+		keys = append(keys, k.String())
+	}
+	sort.Strings(keys)
+
+	return keys, nil
+}
+
+// hasLabel returns true if the service, container or host has the given label.
+// It returns false for objects without labels.
+func hasLabel(label string, in interface{}) bool {
+	labels, ok := labelsOf(in)
+	return ok && labels.Exists(label)
+}
+
+// label returns the value of the label of the service, container or host or
+// the fallback if it doesn't have the label. Objects without labels always
+// result in the fallback.
+func label(in interface{}, key, fallback string) string {
+	labels, ok := labelsOf(in)
+	if !ok || !labels.Exists(key) {
+		return fallback
+	}
+	return labels[key]
+}
+
+// labels returns the labels of the given service, container or host.
+func labels(in interface{}) (LabelMap, error) {
+	l, ok := labelsOf(in)
+	if !ok {
+		return nil, fmt.Errorf("(labels) invalid input type %T", in)
+	}
+	if l == nil {
+		l = LabelMap{}
+	}
+	return l, nil
+}
+
+// labelKeys returns the sorted label keys of the given service, container or host.
+func labelKeys(in interface{}) ([]string, error) {
+	l, ok := labelsOf(in)
+	if !ok {
+		return nil, fmt.Errorf("(labelKeys) invalid input type %T", in)
+	}
+
+	keys := make([]string, 0, len(l))
+	for k := range l {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// labelValues returns the label values of the given service, container or
+// host in the order of the sorted keys.
+func labelValues(in interface{}) ([]string, error) {
+	keys, err := labelKeys(in)
+	if err != nil {
+		return nil, fmt.Errorf("(labelValues) invalid input type %T", in)
+	}
+
+	l, _ := labelsOf(in)
+	values := make([]string, len(keys))
+	for i, k := range keys {
+		values[i] = l[k]
+	}
+	return values, nil
+}
+
+// whereState returns the containers in the given state, e.g. 'running'.
+func whereState(state string, in []Container) []Container {
+	result := make([]Container, 0)
+	for _, c := range in {
+		if strings.EqualFold(c.State, state) {
+			result = append(result, c)
+		}
+	}
+	return result
+}
+
+// isHealthy returns true if the container is healthy or has no health check.
+// A service is healthy if all of its containers are. It returns false for
+// any other input.
+func isHealthy(in interface{}) bool {
+	v := reflect.ValueOf(in)
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return false
+	}
+
+	if f := v.FieldByName("Health"); f.IsValid() && f.Kind() == reflect.String {
+		return isHealthyState(f.String())
+	}
+	if f := v.FieldByName("Containers"); f.IsValid() {
+		containers, ok := f.Interface().([]Container)
+		if !ok {
+			return false
+		}
+		for _, c := range containers {
+			if !isHealthyState(c.Health) {
+				return false
+			}
+		}
+		return true
+	}
+
+	return false
+}
+
+// returns the Labels field of the given struct or pointer to a struct.
+func labelsOf(in interface{}) (LabelMap, bool) {
+	v := reflect.ValueOf(in)
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return nil, false
+	}
+
+	f := v.FieldByName("Labels")
+	if !f.IsValid() {
+		return nil, false
+	}
+	labels, ok := f.Interface().(LabelMap)
+	return labels, ok
+}
+
+// sortByName returns a copy of the slice of services, containers or hosts
+// sorted by name.
+func sortByName(in interface{}) (interface{}, error) {
+	return sortObjects("sortByName", in, func(v interface{}) string {
+		switch typed := v.(type) {
+		case Service:
+			return typed.Name
+		case Container:
+			return typed.Name
+		case Host:
+			return typed.Name
+		}
+		return ""
+	})
+}
+
+// sortByUUID returns a copy of the slice of services, containers or hosts
+// sorted by UUID.
+func sortByUUID(in interface{}) (interface{}, error) {
+	return sortObjects("sortByUUID", in, func(v interface{}) string {
+		switch typed := v.(type) {
+		case Service:
+			return typed.UUID
+		case Container:
+			return typed.UUID
+		case Host:
+			return typed.UUID
+		}
+		return ""
+	})
+}
+
+// first returns the first element of a slice of services, containers or hosts.
+func first(in interface{}) (interface{}, error) {
+	return elementAt("first", in, func(n int) int { return 0 })
+}
+
+// last returns the last element of a slice of services, containers or hosts.
+func last(in interface{}) (interface{}, error) {
+	return elementAt("last", in, func(n int) int { return n - 1 })
+}
+
+// count returns the number of elements of a slice, array or map or the
+// length of a string. It returns 0 for nil and any other input.
+func count(in interface{}) int {
 	if in == nil {
-		return result, fmt.Errorf("(%s) input is nil", funcName)
+		return 0
+	}
+
+	v := reflect.ValueOf(in)
+	switch v.Kind() {
+	case reflect.Slice, reflect.Array, reflect.Map, reflect.String:
+		return v.Len()
+	}
+	return 0
+}
+
+func elementAt(funcName string, in interface{}, index func(int) int) (interface{}, error) {
+	if in == nil {
+		return nil, fmt.Errorf("(%s) input is nil", funcName)
+	}
+
+	v := reflect.ValueOf(in)
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return nil, fmt.Errorf("(%s) invalid input type %T", funcName, in)
+	}
+	if v.Len() == 0 {
+		return nil, fmt.Errorf("(%s) input is empty", funcName)
+	}
+
+	return v.Index(index(v.Len())).Interface(), nil
+}
+
+func sortObjects(funcName string, in interface{}, key func(interface{}) string) (interface{}, error) {
+	if in == nil {
+		return nil, fmt.Errorf("(%s) input is nil", funcName)
+	}
+
+	switch typed := in.(type) {
+	case []Service:
+		result := append([]Service(nil), typed...)
+		sort.SliceStable(result, func(i, j int) bool { return key(result[i]) < key(result[j]) })
+		return result, nil
+	case []Container:
+		result := append([]Container(nil), typed...)
+		sort.SliceStable(result, func(i, j int) bool { return key(result[i]) < key(result[j]) })
+		return result, nil
+	case []Host:
+		result := append([]Host(nil), typed...)
+		sort.SliceStable(result, func(i, j int) bool { return key(result[i]) < key(result[j]) })
+		return result, nil
+	case []interface{}:
+		result := append([]interface{}(nil), typed...)
+		sort.SliceStable(result, func(i, j int) bool { return key(result[i]) < key(result[j]) })
+		return result, nil
+	}
+
+	return nil, fmt.Errorf("(%s) invalid input type %T", funcName, in)
+}
+
+// filterByLabel returns the services, containers or hosts of the input
+// whose label passes the test. The result has the same type as the input.
+func filterByLabel(funcName string, in interface{}, label string, test func(string, bool) bool) (interface{}, error) {
+	if in == nil {
+		return nil, fmt.Errorf("(%s) input is nil", funcName)
 	}
 	if label == "" {
-		return result, fmt.Errorf("(%s) label is empty", funcName)
+		return nil, fmt.Errorf("(%s) label is empty", funcName)
 	}
 
 	switch typed := in.(type) {
 	case []Service:
+		result := make([]Service, 0)
 		for _, s := range typed {
 			value, ok := s.Labels[label]
 			if test(value, ok) {
 				result = append(result, s)
 			}
 		}
+		return result, nil
 	case []Container:
+		result := make([]Container, 0)
 		for _, c := range typed {
 			value, ok := c.Labels[label]
 			if test(value, ok) {
 				result = append(result, c)
 			}
 		}
+		return result, nil
 	case []Host:
-		for _, s := range typed {
-			value, ok := s.Labels[label]
+		result := make([]Host, 0)
+		for _, h := range typed {
+			value, ok := h.Labels[label]
 			if test(value, ok) {
-				result = append(result, s)
+				result = append(result, h)
 			}
 		}
-	default:
-		return result, fmt.Errorf("(%s) invalid input type %T", funcName, in)
+		return result, nil
 	}
 
-	return result, nil
+	return nil, fmt.Errorf("(%s) invalid input type %T", funcName, in)
 }
 
 // selects services or hosts from the input that have the given label
-func whereLabelExists(label string, in interface{}) ([]interface{}, error) {
-	return whereLabel("whereLabelExists", in, label, func(_ string, ok bool) bool {
+func whereLabelExists(label string, in interface{}) (interface{}, error) {
+	return filterByLabel("whereLabelExists", in, label, func(_ string, ok bool) bool {
 		return ok
 	})
 }
 
 // selects services or hosts from the input that have the given label and value
-func whereLabelEquals(label, labelValue string, in interface{}) ([]interface{}, error) {
-	return whereLabel("whereLabelEquals", in, label, func(value string, ok bool) bool {
-		return ok && strings.EqualFold(value, labelValue)
-	})
+func whereLabelEqualsFunc(ctx *TemplateContext) func(string, string, interface{}) (interface{}, error) {
+	return func(label, labelValue string, in interface{}) (interface{}, error) {
+		return filterByLabel("whereLabelEquals", in, label, func(value string, ok bool) bool {
+			return ok && ctx.equal(value, labelValue)
+		})
+	}
 }
 
 // selects services or hosts from the input that have the given label whose value matches the regex
-func whereLabelMatches(label, pattern string, in interface{}) ([]interface{}, error) {
+func whereLabelMatches(label, pattern string, in interface{}) (interface{}, error) {
 	rx, err := regexp.Compile(pattern)
 	if err != nil {
 		return nil, err
 	}
 
-	return whereLabel("whereLabelMatches", in, label, func(value string, ok bool) bool {
+	return filterByLabel("whereLabelMatches", in, label, func(value string, ok bool) bool {
 		return ok && rx.MatchString(value)
 	})
 }
+
+// whereLabelFunc returns a function selecting services, containers or hosts
+// from the input that have the given label with a value equal to or matching
+// the value the same way as a label selector does.
+func whereLabelFunc(ctx *TemplateContext) func(string, string, interface{}) (interface{}, error) {
+	return func(label, labelValue string, in interface{}) (interface{}, error) {
+		return filterByLabel("whereLabel", in, label, func(value string, ok bool) bool {
+			return ok && labelValueMatches(value, labelValue, ctx.caseSensitive)
+		})
+	}
+}
+
+// whereField selects the elements of a slice of structs whose exported field
+// with the given name has a value that prints as the given value. The result
+// has the same type as the input.
+func whereField(field, value string, in interface{}) (interface{}, error) {
+	if in == nil {
+		return nil, fmt.Errorf("(whereField) input is nil")
+	}
+
+	v := reflect.ValueOf(in)
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return nil, fmt.Errorf("(whereField) invalid input type %T", in)
+	}
+	elemType := v.Type().Elem()
+	if elemType.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("(whereField) invalid input type %T", in)
+	}
+	sf, ok := elemType.FieldByName(field)
+	if !ok || sf.PkgPath != "" {
+		return nil, fmt.Errorf("(whereField) unknown field %s for %s", field, elemType.Name())
+	}
+
+	result := reflect.MakeSlice(reflect.SliceOf(elemType), 0, v.Len())
+	for i := 0; i < v.Len(); i++ {
+		elem := v.Index(i)
+		if toString(elem.FieldByIndex(sf.Index).Interface()) == value {
+			result = reflect.Append(result, elem)
+		}
+	}
+	return result.Interface(), nil
+}
+
+// toJSON returns the JSON encoding of the given value.
+func toJSON(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", fmt.Errorf("(json) %v", err)
+	}
+	return string(b), nil
+}
+
+// toPrettyJSON returns the JSON encoding of the given value indented with two spaces.
+func toPrettyJSON(v interface{}) (string, error) {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("(jsonPretty) %v", err)
+	}
+	return string(b), nil
+}
+
+// parseJSON decodes the given JSON string into a map or slice.
+func parseJSON(s string) (interface{}, error) {
+	var v interface{}
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		return nil, fmt.Errorf("(parseJSON) %v", err)
+	}
+	return v, nil
+}
+
+// base64Encode returns the standard base64 encoding of s.
+func base64Encode(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+// base64Decode returns the string represented by the standard base64 encoding s.
+func base64Decode(s string) (string, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return "", fmt.Errorf("(base64Decode) %v", err)
+	}
+	return string(b), nil
+}
+
+// defaultValue returns the fallback if the given value is nil, an empty
+// string or a slice or map without elements.
+func defaultValue(fallback, value interface{}) interface{} {
+	if value == nil {
+		return fallback
+	}
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		if v.Len() == 0 {
+			return fallback
+		}
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return fallback
+		}
+	}
+	return value
+}
+
+// maxSeqLength limits the number of integers returned by seq and seqStep so
+// that a typo in a template can't exhaust the memory.
+const maxSeqLength = 100000
+
+// seq returns the integers from start to end inclusive. The result is empty
+// if start is greater than end.
+func seq(start, end int) ([]int, error) {
+	return sequence("seq", start, end, 1)
+}
+
+// seqStep returns the integers from start to end inclusive, incremented by
+// step. A negative step counts down.
+func seqStep(start, end, step int) ([]int, error) {
+	if step == 0 {
+		return nil, fmt.Errorf("(seqStep) step must not be 0")
+	}
+	return sequence("seqStep", start, end, step)
+}
+
+func sequence(funcName string, start, end, step int) ([]int, error) {
+	if (step > 0 && start > end) || (step < 0 && start < end) {
+		return []int{}, nil
+	}
+
+	// the distance and the stride don't overflow as unsigned integers, even
+	// for ranges spanning most of the int values
+	var dist, stride uint64
+	if step > 0 {
+		dist, stride = uint64(end)-uint64(start), uint64(step)
+	} else {
+		dist, stride = uint64(start)-uint64(end), -uint64(step)
+	}
+	if dist/stride >= maxSeqLength {
+		return nil, fmt.Errorf("(%s) sequence longer than %d elements", funcName, maxSeqLength)
+	}
+
+	n := int(dist/stride) + 1
+	result := make([]int, n)
+	for i, v := 0, start; i < n; i, v = i+1, v+step {
+		result[i] = v
+	}
+	return result, nil
+}
+
+// add returns the sum of two integers or numeric strings.
+func add(a, b interface{}) (int, error) {
+	x, y, err := intOperands("add", a, b)
+	return x + y, err
+}
+
+// sub returns the difference of two integers or numeric strings.
+func sub(a, b interface{}) (int, error) {
+	x, y, err := intOperands("sub", a, b)
+	return x - y, err
+}
+
+// mul returns the product of two integers or numeric strings.
+func mul(a, b interface{}) (int, error) {
+	x, y, err := intOperands("mul", a, b)
+	return x * y, err
+}
+
+// div returns the integer quotient of two integers or numeric strings.
+func div(a, b interface{}) (int, error) {
+	x, y, err := intOperands("div", a, b)
+	if err != nil {
+		return 0, err
+	}
+	if y == 0 {
+		return 0, fmt.Errorf("(div) division by zero")
+	}
+	return x / y, nil
+}
+
+// atoi converts a string holding an integer to int.
+func atoi(s string) (int, error) {
+	i, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("(atoi) invalid number '%s'", s)
+	}
+	return i, nil
+}
+
+// hash returns the 32-bit FNV-1a hash of s.
+func hash(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
+
+// hashMod returns the FNV-1a hash of s modulo n, e.g. to assign names to n
+// buckets in a stable way.
+func hashMod(s string, n int) (int, error) {
+	if n <= 0 {
+		return 0, fmt.Errorf("(hashMod) modulus must be greater than 0")
+	}
+	return int(uint64(hash(s)) % uint64(n)), nil
+}
+
+func intOperands(funcName string, a, b interface{}) (int, int, error) {
+	x, err := toInt(a)
+	if err != nil {
+		return 0, 0, fmt.Errorf("(%s) %v", funcName, err)
+	}
+	y, err := toInt(b)
+	if err != nil {
+		return 0, 0, fmt.Errorf("(%s) %v", funcName, err)
+	}
+	return x, y, nil
+}
+
+// converts a value of any integer kind, a float holding an integer, e.g. a
+// number decoded by parseJSON, or a string holding an integer to int.
+func toInt(v interface{}) (int, error) {
+	if s, ok := v.(string); ok {
+		i, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil {
+			return 0, fmt.Errorf("invalid number '%s'", s)
+		}
+		return i, nil
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i := rv.Int()
+		if i < math.MinInt || i > math.MaxInt {
+			return 0, fmt.Errorf("number %d out of range", i)
+		}
+		return int(i), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		u := rv.Uint()
+		if u > math.MaxInt {
+			return 0, fmt.Errorf("number %d out of range", u)
+		}
+		return int(u), nil
+	case reflect.Float32, reflect.Float64:
+		f := rv.Float()
+		if f != math.Trunc(f) {
+			return 0, fmt.Errorf("number %v isn't an integer", f)
+		}
+		// -math.MinInt is 2^63 (or 2^31), the first float beyond math.MaxInt
+		if f < math.MinInt || f >= -math.MinInt {
+			return 0, fmt.Errorf("number %v out of range", f)
+		}
+		return int(f), nil
+	}
+	return 0, fmt.Errorf("invalid input type %T", v)
+}
+
+// split slices s into the substrings separated by sep. Unlike strings.Split
+// it returns an empty slice for an empty string.
+func split(sep, s string) []string {
+	if s == "" {
+		return []string{}
+	}
+	return strings.Split(s, sep)
+}
+
+// toUpper returns the value converted to a string in upper case. A nil
+// value results in an empty string.
+func toUpper(v interface{}) string {
+	return strings.ToUpper(toString(v))
+}
+
+// toLower returns the value converted to a string in lower case. A nil
+// value results in an empty string.
+func toLower(v interface{}) string {
+	return strings.ToLower(toString(v))
+}
+
+// title returns the value converted to a string with the first letter of
+// each word in upper case. A nil value results in an empty string.
+func title(v interface{}) string {
+	return strings.Title(toString(v))
+}
+
+func toString(v interface{}) string {
+	switch typed := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return typed
+	}
+	return fmt.Sprint(v)
+}
+
+// contains reports whether substr is within s. The string is the last
+// argument so that it can be piped.
+func contains(substr, s string) bool {
+	return strings.Contains(s, substr)
+}
+
+// hasPrefix reports whether s begins with prefix.
+func hasPrefix(prefix, s string) bool {
+	return strings.HasPrefix(s, prefix)
+}
+
+// hasSuffix reports whether s ends with suffix.
+func hasSuffix(suffix, s string) bool {
+	return strings.HasSuffix(s, suffix)
+}
+
+// trim returns s with all leading and trailing characters contained in
+// cutset removed.
+func trim(cutset, s string) string {
+	return strings.Trim(s, cutset)
+}
+
+// trimPrefix returns s without the leading prefix. s is returned unchanged
+// if it doesn't start with prefix.
+func trimPrefix(prefix, s string) string {
+	return strings.TrimPrefix(s, prefix)
+}
+
+// trimSuffix returns s without the trailing suffix. s is returned unchanged
+// if it doesn't end with suffix.
+func trimSuffix(suffix, s string) string {
+	return strings.TrimSuffix(s, suffix)
+}
+
+// replace returns a copy of s with all occurrences of old replaced by new.
+func replace(old, new, s string) string {
+	return strings.Replace(s, old, new, -1)
+}
+
+// replaceN returns a copy of s with the first n occurrences of old replaced
+// by new. If n < 0 all occurrences are replaced.
+func replaceN(old, new string, n int, s string) string {
+	return strings.Replace(s, old, new, n)
+}
+
+// join concatenates the items of a slice of strings, placing sep between
+// them. Items of a []interface{} are converted to strings first.
+func join(sep string, items interface{}) (string, error) {
+	switch typed := items.(type) {
+	case []string:
+		return strings.Join(typed, sep), nil
+	case []interface{}:
+		s := make([]string, len(typed))
+		for i, item := range typed {
+			s[i] = fmt.Sprint(item)
+		}
+		return strings.Join(s, sep), nil
+	}
+
+	return "", fmt.Errorf("(join) invalid input type %T", items)
+}
+
+// env returns the value of the environment variable. If the variable is
+// not set the optional fallback or an empty string is returned.
+func env(name string, fallback ...string) string {
+	if val, ok := os.LookupEnv(name); ok {
+		return val
+	}
+	if len(fallback) > 0 {
+		return fallback[0]
+	}
+	return ""
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"os"
+	"reflect"
+	"testing"
+	"text/template"
+)
+
+// executes the template text with the functions and data of ctx
+func execute(ctx *TemplateContext, text string) (string, error) {
+	tmpl, err := template.New("test").Funcs(newFuncMap(ctx)).Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, ctx)
+	return buf.String(), err
+}
+
+func TestTemplateFuncs(t *testing.T) {
+	os.Setenv("RANCHER_GEN_TEST_ENV", "set")
+	defer os.Unsetenv("RANCHER_GEN_TEST_ENV")
+
+	tests := []struct {
+		text string
+		want string
+	}{
+		// lookups
+		{`{{(service "db").UUID}}`, "svc-db"},
+		{`{{service "missing"}}`, "<no value>"},
+		{`{{(host "host-2").Name}}`, "node2"},
+		{`{{(container "api_api_1").Stack}}`, "api"},
+		{`{{range services ".web"}}{{.Name}} {{end}}`, "db web "},
+		{`{{range hosts "@zone=b"}}{{.Name}}{{end}}`, "node2"},
+		{`{{range containers "@tier=db"}}{{.Name}}{{end}}`, "web_db_1"},
+		{`{{resolveService "web" | join ","}}`, "10.0.0.1"},
+		{`{{resolveService "missing" | len}}`, "0"},
+
+		// strings
+		{`{{split "," "a,b,c" | join "-"}}`, "a-b-c"},
+		{`{{split "," "" | len}}`, "0"},
+		{`{{toUpper "web"}} {{toLower "WEB"}} {{title "web server"}}`, "WEB web Web Server"},
+		{`{{toUpper nil}}`, ""},
+		{`{{toUpper "москва"}} {{toLower "ΑΘΗΝΑ"}} {{title "αθηνα"}}`, "МОСКВА αθηνα Αθηνα"},
+		{`{{contains "eb" "web"}} {{hasPrefix "w" "web"}} {{hasSuffix "x" "web"}}`, "true true false"},
+		{`{{"web.example.com" | replace "." "-"}}`, "web-example-com"},
+		{`{{"a.b.c" | replaceN "." "-" 1}}`, "a-b.c"},
+		{`{{trim "/" "/path/"}}|{{trimSpace "  x  "}}|{{trimPrefix "docker:" "docker:nginx"}}|{{trimSuffix ".tmpl" "a.tmpl"}}`, "path|x|nginx|a"},
+		{`{{env "RANCHER_GEN_TEST_ENV"}} {{env "RANCHER_GEN_TEST_UNSET" "fallback"}}`, "set fallback"},
+		{`{{base64Encode "hello"}} {{base64Decode "aGVsbG8="}}`, "aGVsbG8= hello"},
+
+		// JSON and defaults
+		{`{{(parseJSON "{\"a\": [1, 2]}").a | len}}`, "2"},
+		{`{{parseJSON "[\"x\"]" | json}}`, `["x"]`},
+		{`{{default "none" ""}} {{default "none" "set"}} {{default "none" (services ".none")}}`, "none set none"},
+
+		// numbers
+		{`{{range seq 1 3}}{{.}}{{end}}`, "123"},
+		{`{{range seq 3 1}}{{.}}{{end}}`, ""},
+		{`{{range seqStep 10 0 -5}}{{.}} {{end}}`, "10 5 0 "},
+		{`{{add 1 "2"}} {{sub 5 2}} {{mul 3 4}} {{div 7 2}}`, "3 3 12 3"},
+		{`{{add (hash "x") 1}}`, "4245442696"},
+		{`{{$n := (parseJSON "{\"n\": 3}").n}}{{mul $n 2}} {{sub $n 1}}`, "6 2"},
+		{`{{atoi " 42 "}} {{itoa 42}}`, "42 42"},
+		{`{{hash ""}} {{hash "a"}}`, "2166136261 3826002220"},
+		{`{{hashMod "web-1" 3}} {{hashMod "web-2" 3}}`, "2 1"},
+
+		// labels
+		{`{{hasLabel "tier" (service "db")}} {{hasLabel "none" (service "db")}} {{hasLabel "tier" "string"}}`, "true false false"},
+		{`{{label (container "api_api_1") "leader" "false"}} {{label (container "web_db_1") "leader" "false"}}`, "true false"},
+		{`{{labelKeys (container "api_api_1") | join ","}}`, "leader,tier"},
+		{`{{labelValues (container "api_api_1") | join ","}}`, "true,frontend"},
+		{`{{range $k, $v := labels (host "host-1")}}{{$k}}={{$v}}{{end}}`, "zone=a"},
+		{`{{range whereLabelExists "leader" .Containers}}{{.Name}}{{end}}`, "api_api_1"},
+		{`{{range whereLabelEquals "tier" "WEB" .Containers}}{{.Name}} {{end}}`, "web_web_1 web_web_2 "},
+		{`{{range whereLabelMatches "tier" "^f" .Services}}{{.Name}} {{end}}`, "web api "},
+		{`{{range whereLabel "tier" "db|frontend" .Services}}{{.Name}} {{end}}`, "web db api "},
+		{`{{range whereLabel "tier" "w.*" .Containers}}{{.Name}} {{end}}`, "web_web_1 web_web_2 "},
+		{`{{$g := groupByLabel "tier" .Containers}}{{range sortedKeys $g}}{{.}}:{{len (index $g .)}} {{end}}`, "db:1 frontend:1 web:2 "},
+		{`{{$g := groupByLabel "zone" .Hosts}}{{range sortedKeys $g}}[{{.}}]{{end}}`, "[][a][b]"},
+
+		// collections
+		{`{{range whereState "running" .Containers}}{{.Name}} {{end}}`, "web_web_1 web_web_2 web_db_1 "},
+		{`{{range whereField "Stack" "api" .Containers}}{{.Name}}{{end}}`, "api_api_1"},
+		{`{{range whereField "Scale" "3" .Services}}{{.Name}}{{end}}`, "web"},
+		{`{{isHealthy (container "web_web_1")}} {{isHealthy (container "web_db_1")}} {{isHealthy (container "web_web_2")}}`, "true true false"},
+		{`{{isHealthy (service "db")}} {{isHealthy (service "web")}} {{isHealthy "x"}}`, "true false false"},
+		{`{{range sortByName .Containers}}{{.Name}} {{end}}`, "api_api_1 web_db_1 web_web_1 web_web_2 "},
+		{`{{range sortByUUID .Hosts}}{{.UUID}} {{end}}`, "host-1 host-2 host-3 "},
+		{`{{(first .Containers).Name}} {{(last .Containers).Name}}`, "web_web_1 api_api_1"},
+		{`{{count .Containers}} {{count "abc"}} {{count nil}} {{count 5}}`, "4 3 0 0"},
+	}
+
+	for _, tt := range tests {
+		got, err := execute(newTestContext(), tt.text)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.text, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestTemplateFuncErrors(t *testing.T) {
+	tests := []string{
+		`{{services "bad"}}`,
+		`{{first .Self.Labels}}`,
+		`{{last (split "," "")}}`,
+		`{{div 1 0}}`,
+		`{{add "x" 1}}`,
+		`{{add 1.5 1}}`,
+		`{{add (parseJSON "2.5") 1}}`,
+		`{{atoi "four"}}`,
+		`{{hashMod "a" 0}}`,
+		`{{seqStep 1 5 0}}`,
+		`{{seq 0 2147483647}}`,
+		`{{seqStep 2147483647 0 -1}}`,
+		`{{parseJSON "{"}}`,
+		`{{base64Decode "!"}}`,
+		`{{join "," 5}}`,
+		`{{sortByName "x"}}`,
+		`{{whereLabelExists "" .Services}}`,
+		`{{whereLabelMatches "tier" "(" .Services}}`,
+		`{{whereField "Missing" "x" .Services}}`,
+		`{{whereField "Name" "x" "string"}}`,
+		`{{labelKeys "x"}}`,
+		`{{groupByLabel "tier" "x"}}`,
+		`{{sortedKeys .Containers}}`,
+	}
+
+	for _, text := range tests {
+		if _, err := execute(newTestContext(), text); err == nil {
+			t.Errorf("%s: expected an error", text)
+		}
+	}
+}
+
+func TestSeqStep(t *testing.T) {
+	tests := []struct {
+		start, end, step int
+		want             []int
+	}{
+		{1, 3, 1, []int{1, 2, 3}},
+		{3, 1, 1, []int{}},
+		{1, 3, -1, []int{}},
+		{0, 9, 4, []int{0, 4, 8}},
+		{9, 0, -4, []int{9, 5, 1}},
+		{math.MaxInt - 2, math.MaxInt, 1, []int{math.MaxInt - 2, math.MaxInt - 1, math.MaxInt}},
+		{math.MaxInt - 2, math.MaxInt, 2, []int{math.MaxInt - 2, math.MaxInt}},
+		{math.MinInt + 1, math.MinInt, -1, []int{math.MinInt + 1, math.MinInt}},
+		{math.MinInt, math.MaxInt, math.MaxInt, []int{math.MinInt, -1, math.MaxInt - 1}},
+		{math.MaxInt, math.MinInt, math.MinInt, []int{math.MaxInt, -1}},
+		{0, maxSeqLength - 1, 1, nil},
+	}
+	for _, tt := range tests {
+		got, err := seqStep(tt.start, tt.end, tt.step)
+		if err != nil {
+			t.Errorf("seqStep(%d, %d, %d): unexpected error: %v", tt.start, tt.end, tt.step, err)
+			continue
+		}
+		if tt.want == nil {
+			if len(got) != maxSeqLength {
+				t.Errorf("seqStep(%d, %d, %d) has %d elements; want %d", tt.start, tt.end, tt.step, len(got), maxSeqLength)
+			}
+		} else if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("seqStep(%d, %d, %d) = %v; want %v", tt.start, tt.end, tt.step, got, tt.want)
+		}
+	}
+
+	for _, r := range [][3]int{{0, maxSeqLength, 1}, {math.MinInt, math.MaxInt, 1}, {math.MaxInt, math.MinInt, -1}} {
+		if _, err := seqStep(r[0], r[1], r[2]); err == nil {
+			t.Errorf("seqStep(%d, %d, %d): expected an error", r[0], r[1], r[2])
+		}
+	}
+}
+
+func TestToInt(t *testing.T) {
+	tests := []struct {
+		in   interface{}
+		want int
+		ok   bool
+	}{
+		{42, 42, true},
+		{int8(-8), -8, true},
+		{int64(1 << 40), 1 << 40, true},
+		{uint8(8), 8, true},
+		{uint32(4245442695), 4245442695, true},
+		{uint64(math.MaxInt), math.MaxInt, true},
+		{uint64(math.MaxInt) + 1, 0, false},
+		{float64(3), 3, true},
+		{float32(-2), -2, true},
+		{float64(math.MinInt), math.MinInt, true},
+		{float64(math.MaxInt), 0, false}, // rounds up to 2^63
+		{2.5, 0, false},
+		{math.NaN(), 0, false},
+		{math.Inf(1), 0, false},
+		{" 7 ", 7, true},
+		{"7.0", 0, false},
+		{true, 0, false},
+		{nil, 0, false},
+	}
+	for _, tt := range tests {
+		got, err := toInt(tt.in)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("toInt(%#v) = %d, %v; want %d, ok=%v", tt.in, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestFirstLastEmpty(t *testing.T) {
+	for _, f := range []func(interface{}) (interface{}, error){first, last} {
+		if _, err := f([]Container{}); err == nil {
+			t.Error("expected an error for an empty slice")
+		}
+		if _, err := f(nil); err == nil {
+			t.Error("expected an error for nil")
+		}
+	}
+}
+
+func TestSortObjectsKeepsInput(t *testing.T) {
+	in := []Service{{Name: "b"}, {Name: "a"}}
+	out, err := sortByName(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if in[0].Name != "b" {
+		t.Error("sortByName modified its input")
+	}
+	if !reflect.DeepEqual(out, []Service{{Name: "a"}, {Name: "b"}}) {
+		t.Errorf("sortByName = %v", out)
+	}
+}
+
+func TestJSONFuncs(t *testing.T) {
+	ctx := newTestContext()
+	for _, text := range []string{`{{json .Containers}}`, `{{jsonPretty .Containers}}`} {
+		out, err := execute(ctx, text)
+		if err != nil {
+			t.Fatalf("%s: %v", text, err)
+		}
+		var containers []Container
+		if err := json.Unmarshal([]byte(out), &containers); err != nil {
+			t.Fatalf("%s produced invalid JSON: %v", text, err)
+		}
+		if got := containerNames(containers); got != "web_web_1,web_web_2,web_db_1,api_api_1" {
+			t.Errorf("%s = %q", text, got)
+		}
+	}
+
+	out, _ := execute(ctx, `{{jsonPretty (host "host-3").Labels}}`)
+	if out != "{}" {
+		t.Errorf("jsonPretty of empty labels = %q", out)
+	}
+	out, _ = execute(ctx, `{{jsonPretty (container "web_db_1").Labels}}`)
+	if out != "{\n  \"tier\": \"db\"\n}" {
+		t.Errorf("jsonPretty = %q, want two space indentation", out)
+	}
+
+	if _, err := toJSON(func() {}); err == nil {
+		t.Error("json of a func: expected an error")
+	}
+}
+
+func TestWhereLabelCaseSensitive(t *testing.T) {
+	for _, fn := range []string{"whereLabel", "whereLabelEquals"} {
+		text := `{{range ` + fn + ` "tier" "WEB" .Containers}}{{.Name}} {{end}}`
+		ctx := newTestContext()
+		if got, err := execute(ctx, text); err != nil || got != "web_web_1 web_web_2 " {
+			t.Errorf("case-insensitive %s = %q, %v", fn, got, err)
+		}
+
+		ctx.caseSensitive = true
+		if got, err := execute(ctx, text); err != nil || got != "" {
+			t.Errorf("case-sensitive %s = %q, %v", fn, got, err)
+		}
+	}
+}
+
+func TestHashMod(t *testing.T) {
+	tests := []struct {
+		s    string
+		n    int
+		want int
+	}{
+		{"web-1", 3, 2},
+		{"web-2", 3, 1},
+		{"a", 1, 0},
+		// moduli beyond 32 bits aren't truncated
+		{"a", 1<<32 + 1, 3826002220},
+		{"a", 1 << 32, 3826002220},
+	}
+	for _, tt := range tests {
+		got, err := hashMod(tt.s, tt.n)
+		if err != nil || got != tt.want {
+			t.Errorf("hashMod(%q, %d) = %d, %v; want %d", tt.s, tt.n, got, err, tt.want)
+		}
+	}
+
+	if _, err := hashMod("a", -1); err == nil {
+		t.Error("hashMod with a negative modulus: expected an error")
+	}
+}
+
+func TestDefaultValue(t *testing.T) {
+	var nilPtr *Service
+	tests := []struct {
+		value interface{}
+		want  interface{}
+	}{
+		{nil, "fallback"},
+		{"", "fallback"},
+		{[]string{}, "fallback"},
+		{map[string]string{}, "fallback"},
+		{nilPtr, "fallback"},
+		{"value", "value"},
+		{0, 0},
+		{false, false},
+	}
+	for _, tt := range tests {
+		if got := defaultValue("fallback", tt.value); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("defaultValue(%#v) = %#v, want %#v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestResolveServiceOrder(t *testing.T) {
+	ctx := &TemplateContext{
+		Services: []Service{{Name: "web", Stack: "web", Containers: []Container{
+			{Address: "10.0.0.10", Health: "healthy"},
+			{Address: "10.0.0.9", Health: ""},
+			{Address: "10.0.0.100", Health: "unhealthy"},
+			{Address: "", Health: "healthy"},
+		}}},
+		Self: Self{Stack: "web"},
+	}
+
+	ips, err := resolveServiceFunc(ctx)("web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"10.0.0.9", "10.0.0.10"}; !reflect.DeepEqual(ips, want) {
+		t.Errorf("resolveService(web) = %q, want %q", ips, want)
+	}
+}
@@ -2,52 +2,96 @@ package main
 
 // Service represents a Rancher service.
 type Service struct {
-	Name       string
-	Stack      string
-	Kind       string // service, loadBalancerService
-	Vip        string
-	Fqdn       string
-	Ports      []ServicePort
-	Labels     LabelMap
-	Metadata   MetadataMap
-	Containers []Container
+	UUID            string
+	Name            string
+	Stack           string
+	Kind            string // service, loadBalancerService
+	Vip             string
+	Fqdn            string
+	Scale           int // desired number of containers
+	Ports           []ServicePort
+	PublicEndpoints []PublicEndpoint
+	Labels          LabelMap
+	Metadata        MetadataMap
+	Containers      []Container
+	Sidekicks       []string // names of the sidekick services
+	Links           []string // identifiers of the linked services
+}
+
+// Stack represents a Rancher stack and the services within it.
+type Stack struct {
+	Name     string
+	Services []Service
 }
 
 // Container represents a container belonging to a Rancher Service.
 type Container struct {
-	Name    string
-	Address string
-	Stack   string
-	Service string
-	Health  string
-	State   string
-	Labels  LabelMap
-	Host    Host
+	UUID     string
+	Name     string
+	Address  string   // primary_ip
+	IPs      []string // ips
+	Ports    []PortBinding
+	Stack    string
+	Service  string
+	Health   string
+	State    string
+	Labels   LabelMap
+	HostUUID string
+	Host     Host
+	Image    string // image_uuid without the 'docker:' prefix
 }
 
 // Host represents a Rancher Host.
 type Host struct {
-	UUID     string
-	Name     string
-	Address  string
-	Hostname string
-	Labels   LabelMap
+	UUID       string
+	Name       string
+	Address    string // agent_ip
+	Hostname   string
+	AgentState string
+	Labels     LabelMap
 }
 
 // Self contains information about the container running this application.
 type Self struct {
-	Stack    string
-	Service  string
-	HostUUID string
+	ContainerName string
+	Stack         string
+	Service       string
+	HostUUID      string
+	Labels        LabelMap
+}
+
+// SelfObjects holds the container running this application together with
+// its host and service.
+type SelfObjects struct {
+	Container Container
+	Host      Host
+	Service   Service
 }
 
 // ServicePort represents a port exposed by a service
 type ServicePort struct {
+	BindAddress  string
 	PublicPort   string
 	InternalPort string
 	Protocol     string
 }
 
+// PortBinding represents a port of a container. The public port and IP are
+// empty if the port isn't published on the host.
+type PortBinding struct {
+	PrivatePort string
+	PublicPort  string
+	Protocol    string
+	IP          string
+}
+
+// PublicEndpoint represents an address a service port is published on.
+type PublicEndpoint struct {
+	IPAddress  string
+	PublicPort string
+	Protocol   string
+}
+
 // LabelMap contains the labels of a service or host.
 type LabelMap map[string]string
 
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// authTransport adds basic auth or bearer token credentials to the requests
+// sent to the Metadata API.
+type authTransport struct {
+	base     http.RoundTripper
+	username string
+	password string
+	token    string
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// a RoundTripper must not modify the request it was given
+	req = req.Clone(req.Context())
+	if len(t.token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+t.token)
+	} else {
+		req.SetBasicAuth(t.username, t.password)
+	}
+	return t.base.RoundTrip(req)
+}
+
+// newMetadataTransport returns the transport for requests to the Metadata
+// API with the CA bundle, client certificate and credentials of the config.
+func newMetadataTransport(conf *Config) (http.RoundTripper, error) {
+	tlsConfig := &tls.Config{}
+	if len(conf.MetadataCAFile) > 0 {
+		pem, err := ioutil.ReadFile(conf.MetadataCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in CA file %s", conf.MetadataCAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if len(conf.MetadataCertFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(conf.MetadataCertFile, conf.MetadataKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Could not load client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment}
+	if t, ok := http.DefaultTransport.(*http.Transport); ok {
+		transport = t.Clone()
+	}
+	transport.TLSClientConfig = tlsConfig
+
+	if len(conf.MetadataToken) == 0 && len(conf.MetadataUsername) == 0 {
+		return transport, nil
+	}
+	return &authTransport{
+		base:     transport,
+		username: conf.MetadataUsername,
+		password: conf.MetadataPassword,
+		token:    conf.MetadataToken,
+	}, nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMetadataTransportAuth(t *testing.T) {
+	var got *http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		got = req
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		conf Config
+		want string
+	}{
+		{Config{}, ""},
+		{Config{MetadataToken: "secret"}, "Bearer secret"},
+		{Config{MetadataUsername: "user", MetadataPassword: "pass"}, "Basic dXNlcjpwYXNz"},
+	}
+
+	for _, tt := range tests {
+		transport, err := newMetadataTransport(&tt.conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, _ := http.NewRequest("GET", server.URL, nil)
+		resp, err := (&http.Client{Transport: transport}).Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if h := got.Header.Get("Authorization"); h != tt.want {
+			t.Errorf("Authorization = %q, want %q", h, tt.want)
+		}
+		if req.Header.Get("Authorization") != "" {
+			t.Error("the original request was modified")
+		}
+	}
+}
+
+func TestMetadataTransportCA(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer server.Close()
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := ioutil.WriteFile(caFile, ca, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	transport, err := newMetadataTransport(&Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (&http.Client{Transport: transport}).Get(server.URL); err == nil {
+		t.Error("expected the unknown server certificate to be rejected")
+	}
+
+	transport, err = newMetadataTransport(&Config{MetadataCAFile: caFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := (&http.Client{Transport: transport}).Get(server.URL)
+	if err != nil {
+		t.Fatalf("request with the CA file failed: %v", err)
+	}
+	resp.Body.Close()
+
+	empty := writeFile(t, filepath.Join(dir, "empty.pem"), "")
+	if _, err := newMetadataTransport(&Config{MetadataCAFile: empty}); err == nil {
+		t.Error("expected an error for a CA file without certificates")
+	}
+}
+
+// writes a self-signed client certificate and its key to dir
+func writeClientCert(t *testing.T, dir string) (certFile, keyFile string, cert *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "rancher-gen"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile = writeFile(t, filepath.Join(dir, "client.pem"),
+		string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})))
+	keyFile = writeFile(t, filepath.Join(dir, "client-key.pem"),
+		string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})))
+	return certFile, keyFile, cert
+}
+
+func TestMetadataTransportClientCert(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	certFile, keyFile, cert := writeClientCert(t, dir)
+
+	var auth, client string
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		auth = req.Header.Get("Authorization")
+		client = req.TLS.PeerCertificates[0].Subject.CommonName
+	}))
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: pool}
+	// the rejected handshake is expected
+	server.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	server.StartTLS()
+	defer server.Close()
+
+	caFile := writeFile(t, filepath.Join(dir, "ca.pem"),
+		string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})))
+
+	transport, err := newMetadataTransport(&Config{MetadataCAFile: caFile, MetadataToken: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (&http.Client{Transport: transport}).Get(server.URL); err == nil {
+		t.Error("expected the request without a client certificate to be rejected")
+	}
+
+	transport, err = newMetadataTransport(&Config{
+		MetadataCAFile:   caFile,
+		MetadataCertFile: certFile,
+		MetadataKeyFile:  keyFile,
+		MetadataToken:    "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := (&http.Client{Transport: transport}).Get(server.URL)
+	if err != nil {
+		t.Fatalf("request with the client certificate failed: %v", err)
+	}
+	resp.Body.Close()
+
+	if auth != "Bearer secret" || client != "rancher-gen" {
+		t.Errorf("Authorization = %q, client certificate = %q", auth, client)
+	}
+}